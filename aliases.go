@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// aliasesKey holds the alias registry, a JSON object keyed by the registered aliases.
+const aliasesKey = "aliases.json"
+
+// aliasHeader lists the unregistered aliases of emails tagged by ALIAS_POLICY.
+const aliasHeader = "X-Goemail-Unregistered"
+
+type aliasEntry struct {
+	Created time.Time `json:"created"`
+	// Learned is set when the alias was registered by a reply sent from it
+	Learned  bool `json:"learned,omitempty"`
+	Disabled bool `json:"disabled,omitempty"`
+	// Expires, when set, is when the alias stops being registered
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+func (e aliasEntry) expired(now time.Time) bool {
+	return e.Expires != nil && !now.Before(*e.Expires)
+}
+
+// aliasRegistry maps lower case aliases to their registration.
+type aliasRegistry map[string]aliasEntry
+
+// registered reports whether alias is in the registry, neither disabled nor expired.
+func (r aliasRegistry) registered(alias string) bool {
+	entry, ok := r[extractEmail(alias)]
+	return ok && !entry.Disabled && !entry.expired(time.Now())
+}
+
+// retired reports whether alias is in the registry but disabled or expired.
+func (r aliasRegistry) retired(alias string) bool {
+	_, ok := r[extractEmail(alias)]
+	return ok && !r.registered(alias)
+}
+
+func (r aliasRegistry) sorted() []string {
+	entries := make([]string, 0, len(r))
+	now := time.Now()
+	for alias, entry := range r {
+		switch {
+		case entry.Disabled:
+			alias += " (disabled)"
+		case entry.expired(now):
+			alias += " (expired)"
+		case entry.Expires != nil:
+			alias += expiryNote(*entry.Expires)
+		}
+		entries = append(entries, alias)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// loadAliasPolicy reads ALIAS_POLICY, the action for emails to unregistered aliases. It defaults to
+// forward, which leaves every address not in the registry a catch-all.
+func loadAliasPolicy() verdictAction {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("ALIAS_POLICY")))
+	if value == "" {
+		return actionForward
+	}
+	if action, ok := verdictActionNames[value]; ok {
+		return action
+	}
+	log.Printf("ignoring unknown ALIAS_POLICY %q", value)
+	return actionForward
+}
+
+// loadLearnAliases reads ALIAS_LEARN, false when unset.
+func loadLearnAliases() bool {
+	value := strings.TrimSpace(os.Getenv("ALIAS_LEARN"))
+	if value == "" {
+		return false
+	}
+	learn, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("ignoring invalid ALIAS_LEARN %q", value)
+	}
+	return learn
+}
+
+// cachedAliases returns the registry, re-read after blockCacheTTL. It is nil when there is no
+// registry, before the first alias is created, or it can't be read. An invalid registry is reported.
+func cachedAliases(ctx context.Context, client s3API, bucket *string, ec notifier) aliasRegistry {
+	parse := func(data []byte, source string) interface{} {
+		registry, err := parseAliases(data)
+		if err != nil {
+			log.Printf("ignoring invalid aliases in %s: %s", source, err)
+			ec.Send(fmt.Sprintf("ignoring invalid aliases in %s : %s", source, err))
+			return aliasRegistry(nil)
+		}
+		return registry
+	}
+	registry, found := cachedObject(ctx, client, bucket, aliasesKey, parse, aliasRegistry(nil))
+	if !found {
+		// ALIAS_POLICY applies once the registry exists
+		return nil
+	}
+	return registry.(aliasRegistry)
+}
+
+func parseAliases(data []byte) (aliasRegistry, error) {
+	registry := make(aliasRegistry)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return registry, nil
+	}
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// readAliases returns the stored registry and the ETag it was read at. A missing object is an
+// empty registry with an empty ETag.
+func readAliases(ctx context.Context, client s3API, bucket *string) (aliasRegistry, string, error) {
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String(aliasesKey)})
+	if err != nil {
+		var noSuchKey *s3Types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return make(aliasRegistry), "", nil
+		}
+		return nil, "", err
+	}
+	defer func() { _ = output.Body.Close() }()
+	data, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	registry, err := parseAliases(data)
+	return registry, aws.ToString(output.ETag), err
+}
+
+// modifyAliases applies modify to the stored registry and writes it back, conditional on the ETag
+// it was read at, retrying like modifyBlocks. On success h.aliases is replaced with the stored registry.
+func (h *handler) modifyAliases(ctx context.Context, modify func(aliasRegistry) bool) (err error) {
+	for attempt := 0; attempt < blockUpdateAttempts; attempt++ {
+		var stored aliasRegistry
+		var etag string
+		if stored, etag, err = readAliases(ctx, h.s3Client, h.bucket); err != nil {
+			return err
+		}
+		if modify(stored) {
+			err = putAliases(ctx, h.s3Client, h.bucket, stored, etag)
+			if isPreconditionFailed(err) {
+				log.Printf("%s changed during update, retrying", aliasesKey)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			invalidateObject(h.bucket, aliasesKey)
+		}
+		h.aliases = stored
+		return nil
+	}
+	return fmt.Errorf("giving up updating %s after %d conflicts", aliasesKey, blockUpdateAttempts)
+}
+
+// putAliases writes registry if the stored object still has etag, or does not exist when etag is empty.
+func putAliases(ctx context.Context, client s3API, bucket *string, registry aliasRegistry, etag string) error {
+	body, err := json.MarshalIndent(registry, "", "  ")
+	if err != nil {
+		return err
+	}
+	condition := smithyhttp.SetHeaderValue("If-None-Match", "*")
+	if etag != "" {
+		condition = smithyhttp.SetHeaderValue("If-Match", etag)
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      bucket,
+		Key:         aws.String(aliasesKey),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	}, s3.WithAPIOptions(condition))
+	return err
+}
+
+// createAliases registers aliases until expires, or without expiry when it is zero. Unless learned,
+// aliases already present are enabled again and given the new expiry. It returns the ones that changed.
+func (h *handler) createAliases(ctx context.Context, aliases []string, learned bool, expires time.Time) (created []string, err error) {
+	var expiry *time.Time
+	if !expires.IsZero() {
+		expiry = &expires
+	}
+	err = h.modifyAliases(ctx, func(stored aliasRegistry) bool {
+		created = nil
+		for _, alias := range aliases {
+			entry, ok := stored[alias]
+			switch {
+			case !ok:
+				stored[alias] = aliasEntry{Created: time.Now().UTC(), Learned: learned, Expires: expiry}
+			case !learned && (entry.Disabled || !sameExpiry(entry.Expires, expiry)):
+				entry.Disabled, entry.Expires = false, expiry
+				stored[alias] = entry
+			default:
+				continue
+			}
+			created = append(created, alias)
+		}
+		return len(created) > 0
+	})
+	return created, err
+}
+
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// disableAliases marks registered aliases disabled and returns the ones that changed.
+func (h *handler) disableAliases(ctx context.Context, aliases []string) (disabled []string, err error) {
+	err = h.modifyAliases(ctx, func(stored aliasRegistry) bool {
+		disabled = nil
+		for _, alias := range aliases {
+			if entry, ok := stored[alias]; ok && !entry.Disabled {
+				entry.Disabled = true
+				stored[alias] = entry
+				disabled = append(disabled, alias)
+			}
+		}
+		return len(disabled) > 0
+	})
+	return disabled, err
+}
+
+// learnAlias registers alias when ALIAS_LEARN is set and it isn't in the registry yet.
+func (h *handler) learnAlias(ctx context.Context, alias string) {
+	if !h.learnAliases {
+		return
+	}
+	if _, ok := h.aliases[alias]; ok {
+		return
+	}
+	created, err := h.createAliases(ctx, []string{alias}, true, time.Time{})
+	if err != nil {
+		log.Printf("Error registering alias %s: %s", alias, err)
+		return
+	}
+	if len(created) > 0 {
+		log.Printf("Learned alias %s", alias)
+	}
+}
+
+// aliasAction returns the action for sesMail when none of its recipients is a registered alias,
+// along with those recipients. Unregistered aliases get ALIAS_POLICY. Disabled and expired aliases
+// get it too, but are dropped when it is forward. Reply addresses are not aliases.
+func (h *handler) aliasAction(sesMail events.SimpleEmailMessage) (verdictAction, []string) {
+	if h.aliases == nil {
+		return actionForward, nil
+	}
+	var unknown []string
+	retired := true
+	for _, dest := range sesMail.Destination {
+		if _, ok := parseReplyAddress(dest, h.replyDomain); ok && h.replyDomain != "" {
+			continue
+		}
+		if h.aliases.registered(dest) {
+			return actionForward, nil
+		}
+		retired = retired && h.aliases.retired(dest)
+		unknown = append(unknown, extractEmail(dest))
+	}
+	if len(unknown) == 0 {
+		return actionForward, nil
+	}
+	if h.aliasPolicy == actionForward && retired {
+		return actionDrop, unknown
+	}
+	return h.aliasPolicy, unknown
+}
+
+// aliasEntries returns the addresses in args that h may register or disable.
+func (h *handler) aliasEntries(args []string) []string {
+	entries := make([]string, 0)
+	for _, arg := range args {
+		alias := extractEmail(arg)
+		switch {
+		case !strings.Contains(alias, "@") || strings.ContainsAny(alias, "*?["):
+			log.Printf("ignoring invalid alias %q", arg)
+		case !h.owns(alias):
+			log.Printf("ignoring %s not routed to %s", alias, h.scope)
+		default:
+			entries = append(entries, alias)
+		}
+	}
+	return entries
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// aliasHandler returns a handler whose bucket holds the registry in *stored, missing while it is empty.
+func aliasHandler(stored *string) (*handler, *mockSES, *mockS3) {
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := "From: sender@example.com\r\nTo: random@mlctrez.com\r\nSubject: Deal\r\n\r\nbody\r\n"
+			if aws.ToString(params.Key) == aliasesKey {
+				if *stored == "" {
+					return nil, &s3Types.NoSuchKey{}
+				}
+				body = *stored
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			buf, _ := io.ReadAll(params.Body)
+			*stored = string(buf)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	return &handler{
+		s3Client:  mock,
+		sesClient: sesMock,
+		bucket:    aws.String("bucket"),
+		from:      "forwarder@mlctrez.com",
+		to:        "owner@gmail.com",
+		ec:        &mockNotifier{},
+	}, sesMock, mock
+}
+
+func TestHandleRecord_AliasPolicy(t *testing.T) {
+	stored := `{"shop@mlctrez.com": {"created": "2026-01-02T03:04:05Z"}, "old@mlctrez.com": {"created": "2026-01-02T03:04:05Z", "disabled": true}}`
+	h, sesMock, mock := aliasHandler(&stored)
+	h.aliases, _ = parseAliases([]byte(stored))
+	h.aliasPolicy = actionDrop
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "sender@example.com"
+
+	for _, dest := range []string{"random@mlctrez.com", "Old <old@mlctrez.com>"} {
+		record.SES.Mail.Destination = []string{dest}
+		if disposition := h.handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+			t.Errorf("expected mail to %s to be dropped, disposition %s", dest, disposition)
+		}
+	}
+	if len(sesMock.sent) != 0 || len(mock.deleted) != 2 {
+		t.Errorf("expected nothing sent and both deleted, sent %d deleted %v", len(sesMock.sent), mock.deleted)
+	}
+
+	record.SES.Mail.Destination = []string{"random@mlctrez.com", "shop@mlctrez.com"}
+	h.handleRecord(context.Background(), record)
+	if len(sesMock.sent) != 1 {
+		t.Fatalf("expected mail to a registered alias to be forwarded, sent %d", len(sesMock.sent))
+	}
+
+	h.aliasPolicy = actionTag
+	record.SES.Mail.Destination = []string{"random@mlctrez.com"}
+	h.handleRecord(context.Background(), record)
+	if len(sesMock.sent) != 2 || !strings.Contains(string(sesMock.sent[1].RawMessage.Data), aliasHeader+": random@mlctrez.com\r\n") {
+		t.Errorf("expected the unregistered alias to be tagged, got %v", sesMock.sent)
+	}
+}
+
+func TestCommand_CreateDisable(t *testing.T) {
+	var stored string
+	h, _, _ := aliasHandler(&stored)
+	ec := h.ec.(*mockNotifier)
+
+	sesMail := events.SimpleEmailMessage{MessageID: "message-id"}
+	sesMail.CommonHeaders.Subject = "create Shop@mlctrez.com *@mlctrez.com news@mlctrez.com"
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected create command to be handled")
+	}
+	registry, _ := parseAliases([]byte(stored))
+	if len(registry) != 2 || !registry.registered("shop@mlctrez.com") || !registry.registered("news@mlctrez.com") {
+		t.Fatalf("expected two registered aliases, stored %s", stored)
+	}
+
+	sesMail.CommonHeaders.Subject = "create trip@mlctrez.com 1w"
+	h.command(context.Background(), sesMail)
+
+	sesMail.CommonHeaders.Subject = "disable news@mlctrez.com trip@mlctrez.com unknown@mlctrez.com"
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected disable command to be handled")
+	}
+	registry, _ = parseAliases([]byte(stored))
+	if registry.registered("news@mlctrez.com") || registry.registered("trip@mlctrez.com") || !registry.registered("shop@mlctrez.com") {
+		t.Errorf("expected news@mlctrez.com and trip@mlctrez.com to be disabled, stored %s", stored)
+	}
+	if registry["trip@mlctrez.com"].Expires == nil {
+		t.Errorf("expected disable to keep the expiry, stored %s", stored)
+	}
+	if _, ok := registry["unknown@mlctrez.com"]; ok {
+		t.Errorf("expected disable not to register unknown aliases, stored %s", stored)
+	}
+	if len(ec.messages) != 3 || ec.messages[2] != "Disabled aliases: [news@mlctrez.com trip@mlctrez.com]" {
+		t.Errorf("unexpected messages %v", ec.messages)
+	}
+}
+
+func TestLearnAlias(t *testing.T) {
+	stored := `{"old@mlctrez.com": {"created": "2026-01-02T03:04:05Z", "disabled": true}}`
+	h, _, _ := aliasHandler(&stored)
+	h.aliases, _ = parseAliases([]byte(stored))
+
+	h.learnAlias(context.Background(), "shop@mlctrez.com")
+	if strings.Contains(stored, "shop@mlctrez.com") {
+		t.Fatal("expected nothing to be learned without ALIAS_LEARN")
+	}
+
+	h.learnAliases = true
+	h.learnAlias(context.Background(), "shop@mlctrez.com")
+	h.learnAlias(context.Background(), "old@mlctrez.com")
+	registry, _ := parseAliases([]byte(stored))
+	if !registry.registered("shop@mlctrez.com") || !registry["shop@mlctrez.com"].Learned {
+		t.Errorf("expected shop@mlctrez.com to be learned, stored %s", stored)
+	}
+	if registry.registered("old@mlctrez.com") {
+		t.Errorf("expected a disabled alias to stay disabled, stored %s", stored)
+	}
+}
+
+func TestHandleRecord_ExpiredAlias(t *testing.T) {
+	stored := `{"trip@mlctrez.com": {"created": "2026-01-02T03:04:05Z", "expires": "2026-01-09T03:04:05Z"}}`
+	h, sesMock, mock := aliasHandler(&stored)
+	h.aliases, _ = parseAliases([]byte(stored))
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "sender@example.com"
+	record.SES.Mail.Destination = []string{"trip@mlctrez.com"}
+	if disposition := h.handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("expected mail to an expired alias to be dropped, disposition %s", disposition)
+	}
+
+	record.SES.Mail.Destination = []string{"random@mlctrez.com"}
+	h.handleRecord(context.Background(), record)
+	if len(sesMock.sent) != 1 || len(mock.deleted) != 2 {
+		t.Errorf("expected only the unregistered alias to be forwarded, sent %d deleted %v", len(sesMock.sent), mock.deleted)
+	}
+}
+
+func TestCommand_CreateTTL(t *testing.T) {
+	var stored string
+	h, _, _ := aliasHandler(&stored)
+
+	sesMail := events.SimpleEmailMessage{MessageID: "message-id"}
+	sesMail.CommonHeaders.Subject = "create trip@mlctrez.com 1w"
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected create command to be handled")
+	}
+	registry, _ := parseAliases([]byte(stored))
+	entry := registry["trip@mlctrez.com"]
+	if entry.Expires == nil || entry.Expires.Sub(entry.Created) < 7*24*time.Hour-time.Second || !registry.registered("trip@mlctrez.com") {
+		t.Errorf("expected the alias to expire in a week, stored %s", stored)
+	}
+
+	sesMail.CommonHeaders.Subject = "create trip@mlctrez.com"
+	h.command(context.Background(), sesMail)
+	if registry, _ = parseAliases([]byte(stored)); registry["trip@mlctrez.com"].Expires != nil {
+		t.Errorf("expected create without a ttl to make the alias permanent, stored %s", stored)
+	}
+}
+
+func TestCachedAliases(t *testing.T) {
+	var stored string
+	reads := 0
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			reads++
+			if stored == "" {
+				return nil, &s3Types.NoSuchKey{}
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(stored))}, nil
+		},
+	}
+	bucket := aws.String("aliases-bucket")
+	defer invalidateObject(bucket, aliasesKey)
+	ec := &mockNotifier{}
+
+	cachedAliases(context.Background(), mock, bucket, ec)
+	if registry := cachedAliases(context.Background(), mock, bucket, ec); registry != nil || reads != 1 {
+		t.Errorf("expected a missing registry to be cached as nil, got %v after %d reads", registry, reads)
+	}
+
+	stored = "{not json"
+	invalidateObject(bucket, aliasesKey)
+	if registry := cachedAliases(context.Background(), mock, bucket, ec); registry != nil || len(ec.messages) != 1 {
+		t.Errorf("expected an invalid registry to be reported, got %v and %v", registry, ec.messages)
+	}
+
+	stored = `{"shop@mlctrez.com": {"created": "2026-01-02T03:04:05Z"}}`
+	invalidateObject(bucket, aliasesKey)
+	if registry := cachedAliases(context.Background(), mock, bucket, ec); !registry.registered("shop@mlctrez.com") {
+		t.Errorf("expected the stored registry, got %v", registry)
+	}
+}
+
+func TestPutAliases_Condition(t *testing.T) {
+	client, headers := recordingS3(t)
+	registry := aliasRegistry{"shop@mlctrez.com": {}}
+
+	if err := putAliases(context.Background(), client, aws.String("bucket"), registry, `"1"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := putAliases(context.Background(), client, aws.String("bucket"), registry, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(*headers) != 2 {
+		t.Fatalf("expected two requests, got %d", len(*headers))
+	}
+	if h := (*headers)[0]; h.Get("If-Match") != `"1"` || h.Get("If-None-Match") != "" {
+		t.Errorf("expected If-Match for a stored registry, got %v", h)
+	}
+	if h := (*headers)[1]; h.Get("If-None-Match") != "*" || h.Get("If-Match") != "" {
+		t.Errorf("expected If-None-Match for a missing registry, got %v", h)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mlctrez/goemail/sesutil"
+)
+
+const attachmentsPrefix = "attachments/"
+
+// loadOffloadLimit reads OFFLOAD_LIMIT, the size in bytes above which attachments of forwarded
+// emails are moved to the bucket. Zero, the default, disables offloading.
+func loadOffloadLimit() int {
+	value := strings.TrimSpace(os.Getenv("OFFLOAD_LIMIT"))
+	if value == "" {
+		return 0
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		log.Printf("ignoring invalid OFFLOAD_LIMIT %q", value)
+		return 0
+	}
+	return limit
+}
+
+// attachmentName keeps the characters of filename that are safe in an object key.
+func attachmentName(filename string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, filename)
+	if strings.Trim(name, "._") == "" {
+		return "attachment"
+	}
+	return name
+}
+
+// storeAttachment returns a sesutil.OffloadFunc that stores attachments of messageID under
+// attachmentsPrefix and links to them with presigned URLs.
+func (h *handler) storeAttachment(ctx context.Context, messageID string) sesutil.OffloadFunc {
+	index := 0
+	return func(attachment sesutil.Attachment) (string, error) {
+		index++
+		key := fmt.Sprintf("%s%s/%d-%s", attachmentsPrefix,
+			strings.TrimPrefix(messageID, quarantinePrefix), index, attachmentName(attachment.Filename))
+		input := &s3.PutObjectInput{
+			Bucket:      h.bucket,
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(attachment.Data),
+			ContentType: aws.String(attachment.ContentType),
+		}
+		if attachment.Filename != "" {
+			input.ContentDisposition = aws.String(mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+		}
+		if _, err := h.s3Client.PutObject(ctx, input); err != nil {
+			return "", err
+		}
+		psReq, err := h.presigner.PresignGetObject(ctx, &s3.GetObjectInput{Bucket: h.bucket, Key: aws.String(key)})
+		if err != nil {
+			return "", err
+		}
+		return psReq.URL, nil
+	}
+}
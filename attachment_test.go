@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestForward_Offload(t *testing.T) {
+	message := "From: sender@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"See attached.\r\n" +
+		"--b\r\n" +
+		"Content-Type: application/zip\r\n" +
+		"Content-Disposition: attachment; filename=\"big file?.zip\"\r\n" +
+		"\r\n" +
+		strings.Repeat("z", 5000) + "\r\n" +
+		"--b--\r\n"
+
+	var putKeys []string
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(message))}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			putKeys = append(putKeys, aws.ToString(params.Key))
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	h := &handler{
+		s3Client:     mock,
+		presigner:    &mockPresigner{},
+		sesClient:    sesMock,
+		bucket:       aws.String("bucket"),
+		from:         "forwarder@mlctrez.com",
+		to:           "owner@gmail.com",
+		ec:           &mockNotifier{},
+		offloadLimit: 1000,
+	}
+
+	if err := h.forward(context.Background(), "message-id", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(putKeys) != 1 || putKeys[0] != "attachments/message-id/1-big_file_.zip" {
+		t.Errorf("put keys = %v", putKeys)
+	}
+	if len(sesMock.sent) != 1 {
+		t.Fatalf("expected one email, got %d", len(sesMock.sent))
+	}
+	output := string(sesMock.sent[0].RawMessage.Data)
+	if len(output) > 1000 || !strings.Contains(output, "https://bucket.s3.amazonaws.com/attachments/message-id/1-big_file_.zip") {
+		t.Errorf("expected attachment to be replaced by a link. Got:\n%s", output)
+	}
+}
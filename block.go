@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const blocksKey = "blocks.txt"
+
+// sendersKey holds the sender blocklist, using the same entry format as blocksKey.
+const sendersKey = "senders.txt"
+
+// blockList holds the entries of blocks.txt. An entry is one of
+//   - an exact address: spam@example.com
+//   - a glob pattern matched against the whole address: *@spammy.example.com, newsletter-*@example.com
+//   - a domain, optionally prefixed with @, matching the domain and its subdomains: @example.com
+//
+// Each line may follow the entry with tab separated added=, expires= and reason= fields.
+type blockList map[string]blockEntry
+
+// blockEntry records when and why an entry was added and when it expires, never when Expires is zero.
+type blockEntry struct {
+	Added   time.Time
+	Expires time.Time
+	Reason  string
+}
+
+func (e blockEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+// match returns the entry that blocks address. Expired entries are ignored.
+func (b blockList) match(address string) (string, bool) {
+	address = extractEmail(address)
+	now := time.Now()
+	if e, ok := b[address]; ok && !e.expired(now) {
+		return address, true
+	}
+	_, domain, _ := strings.Cut(address, "@")
+	for entry, e := range b {
+		if !e.expired(now) && blockMatches(entry, address, domain) {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+// parseBlockLine reads an entry and its fields from a line of a blocklist. Unknown or invalid
+// fields are ignored so that hand edited lists keep working.
+func parseBlockLine(line string) (string, blockEntry) {
+	fields := strings.Split(line, "\t")
+	var e blockEntry
+	for _, field := range fields[1:] {
+		name, value, _ := strings.Cut(field, "=")
+		switch strings.TrimSpace(name) {
+		case "added":
+			e.Added, _ = time.Parse(time.RFC3339, strings.TrimSpace(value))
+		case "expires":
+			e.Expires, _ = time.Parse(time.RFC3339, strings.TrimSpace(value))
+		case "reason":
+			e.Reason = strings.TrimSpace(value)
+		}
+	}
+	return normalizeBlock(fields[0]), e
+}
+
+// formatBlockLine is the line parseBlockLine reads entry and e from.
+func formatBlockLine(entry string, e blockEntry) string {
+	line := entry
+	if !e.Added.IsZero() {
+		line += "\tadded=" + e.Added.UTC().Format(time.RFC3339)
+	}
+	if !e.Expires.IsZero() {
+		line += "\texpires=" + e.Expires.UTC().Format(time.RFC3339)
+	}
+	if e.Reason != "" {
+		line += "\treason=" + strings.Join(strings.Fields(e.Reason), " ")
+	}
+	return line
+}
+
+func blockMatches(entry, address, domain string) bool {
+	if strings.ContainsAny(entry, "*?[") {
+		ok, _ := path.Match(entry, address)
+		return ok
+	}
+	if strings.HasPrefix(entry, "@") || !strings.Contains(entry, "@") {
+		entryDomain := strings.TrimPrefix(entry, "@")
+		return domain == entryDomain || strings.HasSuffix(domain, "."+entryDomain)
+	}
+	return entry == address
+}
+
+// normalizeBlock lower cases an entry given to the block command, keeping patterns and domains intact.
+func normalizeBlock(entry string) string {
+	if strings.ContainsAny(entry, "*?[") || !strings.Contains(entry, "@") || strings.HasPrefix(entry, "@") {
+		return strings.ToLower(strings.TrimSpace(entry))
+	}
+	return extractEmail(entry)
+}
+
+// isBlockEntry reports whether arg has the form of an entry: an address, a pattern, or a domain
+// such as example.com made of labels of letters, digits and hyphens.
+func isBlockEntry(arg string) bool {
+	if strings.Contains(arg, "@") || strings.ContainsAny(arg, "*?[") {
+		return true
+	}
+	labels := strings.Split(strings.ToLower(arg), ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if label == "" || strings.Trim(label, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// blockUpdateAttempts bounds the retries of a conditional blocklist write that lost a race.
+const blockUpdateAttempts = 5
+
+func getBlocks(ctx context.Context, client s3API, bucket *string, key string) blockList {
+	res, _, err := readBlocks(ctx, client, bucket, key, "")
+	if err != nil {
+		log.Printf("Error reading %s: %s", key, err)
+	}
+	return res
+}
+
+type blockCacheEntry struct {
+	list    blockList
+	etag    string
+	checked time.Time
+}
+
+var (
+	blockCacheMu sync.Mutex
+	// blockCache keeps blocklists across warm invocations, keyed by bucket and key.
+	blockCache = make(map[string]*blockCacheEntry)
+	// blockCacheTTL is how long a cached blocklist is used before it is revalidated, set with BLOCKS_TTL.
+	blockCacheTTL = envDuration("BLOCKS_TTL", time.Minute)
+)
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if value := os.Getenv(name); value != "" {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		log.Printf("ignoring invalid duration %q for %s", value, name)
+	}
+	return fallback
+}
+
+// cachedBlocks returns a copy of the blocklist at key. Within blockCacheTTL the cached list is used
+// as is, after that it is revalidated with a GetObject conditional on the cached ETag.
+func cachedBlocks(ctx context.Context, client s3API, bucket *string, key string) blockList {
+	blockCacheMu.Lock()
+	defer blockCacheMu.Unlock()
+
+	cacheKey := aws.ToString(bucket) + "/" + key
+	entry := blockCache[cacheKey]
+	if entry == nil || time.Since(entry.checked) >= blockCacheTTL {
+		var ifNoneMatch string
+		if entry != nil {
+			ifNoneMatch = entry.etag
+		}
+		list, etag, err := readBlocks(ctx, client, bucket, key, ifNoneMatch)
+		switch {
+		case isNotModified(err):
+			entry.checked = time.Now()
+		case err != nil:
+			log.Printf("Error reading %s: %s", key, err)
+			if entry == nil {
+				return list
+			}
+		default:
+			entry = &blockCacheEntry{list: list, etag: etag, checked: time.Now()}
+			blockCache[cacheKey] = entry
+		}
+	}
+
+	res := make(blockList, len(entry.list))
+	for k, e := range entry.list {
+		res[k] = e
+	}
+	return res
+}
+
+func invalidateBlocks(bucket *string, key string) {
+	blockCacheMu.Lock()
+	defer blockCacheMu.Unlock()
+	delete(blockCache, aws.ToString(bucket)+"/"+key)
+}
+
+func isNotModified(err error) bool {
+	var respErr interface{ HTTPStatusCode() int }
+	return errors.As(err, &respErr) && respErr.HTTPStatusCode() == http.StatusNotModified
+}
+
+// readBlocks returns the entries stored at key and the ETag they were read at.
+// A missing object is an empty list with an empty ETag. When ifNoneMatch is set and the object
+// still has that ETag the error satisfies isNotModified.
+func readBlocks(ctx context.Context, client s3API, bucket *string, key, ifNoneMatch string) (res blockList, etag string, err error) {
+	res = make(blockList)
+	input := &s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    aws.String(key),
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+	output, err := client.GetObject(ctx, input)
+	if err != nil {
+		var noSuchKey *s3Types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return res, "", nil
+		}
+		return res, "", err
+	}
+	defer func() { _ = output.Body.Close() }()
+	body, err := io.ReadAll(output.Body)
+	if err != nil {
+		return res, "", err
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if entry, e := parseBlockLine(line); entry != "" {
+			res[entry] = e
+		}
+	}
+	return res, aws.ToString(output.ETag), nil
+}
+
+// modifyBlocks applies modify to the stored list at key and writes it back, conditional on the ETag
+// it was read at, leaving out expired entries. When another invocation wrote the list in the meantime
+// the list is re-read and modify applied again. On success current is replaced with the stored entries.
+func modifyBlocks(ctx context.Context, client s3API, bucket *string, key string, current blockList, modify func(blockList) bool) (err error) {
+	for attempt := 0; attempt < blockUpdateAttempts; attempt++ {
+		var stored blockList
+		var etag string
+		if stored, etag, err = readBlocks(ctx, client, bucket, key, ""); err != nil {
+			return err
+		}
+		now := time.Now()
+		expired := false
+		for k, e := range stored {
+			if e.expired(now) {
+				delete(stored, k)
+				expired = true
+			}
+		}
+		if changed := modify(stored); changed || expired {
+			err = putBlocks(ctx, client, bucket, key, stored, etag)
+			if isPreconditionFailed(err) {
+				log.Printf("%s changed during update, retrying", key)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			invalidateBlocks(bucket, key)
+		}
+		for k := range current {
+			delete(current, k)
+		}
+		for k, e := range stored {
+			current[k] = e
+		}
+		return nil
+	}
+	return fmt.Errorf("giving up updating %s after %d conflicts", key, blockUpdateAttempts)
+}
+
+func isPreconditionFailed(err error) bool {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "PreconditionFailed", "ConditionalRequestConflict":
+			return true
+		}
+	}
+	return false
+}
+
+// updateBlocks adds news to the list at key recorded with entry. Those already present keep when
+// they were added and get the expiry and reason of entry.
+func updateBlocks(ctx context.Context, client s3API, bucket *string, key string, current blockList, news []string, entry blockEntry) {
+	err := modifyBlocks(ctx, client, bucket, key, current, func(stored blockList) (changed bool) {
+		for _, n := range news {
+			n = normalizeBlock(n)
+			e, ok := stored[n]
+			updated := entry
+			if ok && !e.Added.IsZero() {
+				updated.Added = e.Added
+			}
+			if !ok || e != updated {
+				stored[n] = updated
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		log.Printf("Error updating %s: %s", key, err)
+	}
+}
+
+// removeBlocks deletes entries from the list at key and returns the ones that were present.
+func removeBlocks(ctx context.Context, client s3API, bucket *string, key string, current blockList, entries []string) (removed []string) {
+	err := modifyBlocks(ctx, client, bucket, key, current, func(stored blockList) bool {
+		removed = nil
+		for _, e := range entries {
+			e = normalizeBlock(e)
+			if _, ok := stored[e]; ok {
+				delete(stored, e)
+				removed = append(removed, e)
+			}
+		}
+		return len(removed) > 0
+	})
+	if err != nil {
+		log.Printf("Error updating %s: %s", key, err)
+		return nil
+	}
+	return removed
+}
+
+func (b blockList) sorted() []string {
+	entries := make([]string, 0, len(b))
+	for k := range b {
+		entries = append(entries, k)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// describe lists the entries with their expiry and reason for the blocks command.
+func (b blockList) describe() []string {
+	lines := make([]string, 0, len(b))
+	for _, k := range b.sorted() {
+		line, e := k, b[k]
+		line += expiryNote(e.Expires)
+		if e.Reason != "" {
+			line += " (" + e.Reason + ")"
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// putBlocks writes entries to key if the stored object still has etag, or does not exist when etag is empty.
+func putBlocks(ctx context.Context, client s3API, bucket *string, key string, entries blockList, etag string) error {
+	var sb strings.Builder
+	for _, k := range entries.sorted() {
+		sb.WriteString(formatBlockLine(k, entries[k]))
+		sb.WriteString("\n")
+	}
+	condition := smithyhttp.SetHeaderValue("If-None-Match", "*")
+	if etag != "" {
+		condition = smithyhttp.SetHeaderValue("If-Match", etag)
+	}
+	_, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: bucket,
+		Key:    aws.String(key),
+		Body:   strings.NewReader(sb.String()),
+	}, s3.WithAPIOptions(condition))
+	return err
+}
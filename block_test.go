@@ -3,17 +3,27 @@ package main
 import (
 	"context"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
 
 type mockS3 struct {
 	s3API
-	getObjectFunc func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
-	putObjectFunc func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	getObjectFunc   func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	putObjectFunc   func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	headObjectFunc  func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	listObjectsFunc func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+	deleted         []string
+	copied          []*s3.CopyObjectInput
 }
 
 func (m *mockS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
@@ -24,6 +34,29 @@ func (m *mockS3) PutObject(ctx context.Context, params *s3.PutObjectInput, optFn
 	return m.putObjectFunc(ctx, params, optFns...)
 }
 
+func (m *mockS3) DeleteObjects(_ context.Context, params *s3.DeleteObjectsInput, _ ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	for _, o := range params.Delete.Objects {
+		m.deleted = append(m.deleted, *o.Key)
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func (m *mockS3) CopyObject(_ context.Context, params *s3.CopyObjectInput, _ ...func(*s3.Options)) (*s3.CopyObjectOutput, error) {
+	m.copied = append(m.copied, params)
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3) HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+	if m.headObjectFunc == nil {
+		return nil, &s3Types.NotFound{}
+	}
+	return m.headObjectFunc(ctx, params, optFns...)
+}
+
+func (m *mockS3) ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+	return m.listObjectsFunc(ctx, params, optFns...)
+}
+
 func TestGetBlocks(t *testing.T) {
 	mock := &mockS3{
 		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
@@ -34,7 +67,7 @@ func TestGetBlocks(t *testing.T) {
 		},
 	}
 
-	blocks := getBlocks(context.Background(), mock, aws.String("bucket"))
+	blocks := getBlocks(context.Background(), mock, aws.String("bucket"), blocksKey)
 	if _, ok := blocks["shady@mlctrez.com"]; !ok {
 		t.Error("expected shady@mlctrez.com to be in blocks")
 	}
@@ -68,6 +101,12 @@ func TestExtractEmail(t *testing.T) {
 func TestUpdateBlocks(t *testing.T) {
 	var putBody string
 	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{
+				Body: io.NopCloser(strings.NewReader("old@mlctrez.com\n")),
+				ETag: aws.String(`"1"`),
+			}, nil
+		},
 		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
 			buf, _ := io.ReadAll(params.Body)
 			putBody = string(buf)
@@ -75,10 +114,10 @@ func TestUpdateBlocks(t *testing.T) {
 		},
 	}
 
-	current := map[string]struct{}{
+	current := blockList{
 		"old@mlctrez.com": {},
 	}
-	updateBlocks(context.Background(), mock, aws.String("bucket"), current, []string{"new@mlctrez.com"})
+	updateBlocks(context.Background(), mock, aws.String("bucket"), blocksKey, current, []string{"new@mlctrez.com"}, blockEntry{})
 
 	if !strings.Contains(putBody, "old@mlctrez.com") {
 		t.Error("expected old@mlctrez.com in put body")
@@ -87,3 +126,236 @@ func TestUpdateBlocks(t *testing.T) {
 		t.Error("expected new@mlctrez.com in put body")
 	}
 }
+
+func TestUpdateBlocks_Conflict(t *testing.T) {
+	stored := "old@mlctrez.com\n"
+	etag := `"1"`
+	var putBody string
+	puts := 0
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{
+				Body: io.NopCloser(strings.NewReader(stored)),
+				ETag: aws.String(etag),
+			}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			puts++
+			if puts == 1 {
+				// another invocation added an entry after our read
+				stored = "old@mlctrez.com\nother@mlctrez.com\n"
+				etag = `"2"`
+				return nil, &smithy.GenericAPIError{Code: "PreconditionFailed"}
+			}
+			buf, _ := io.ReadAll(params.Body)
+			putBody = string(buf)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	current := blockList{"old@mlctrez.com": {}}
+	updateBlocks(context.Background(), mock, aws.String("bucket"), blocksKey, current, []string{"new@mlctrez.com"}, blockEntry{})
+
+	if puts != 2 {
+		t.Errorf("expected a retry after the conflict, got %d puts", puts)
+	}
+	expected := "new@mlctrez.com\nold@mlctrez.com\nother@mlctrez.com\n"
+	if putBody != expected {
+		t.Errorf("put body = %q; want %q", putBody, expected)
+	}
+	if len(current) != 3 {
+		t.Errorf("expected current to hold the merged entries, got %v", current)
+	}
+}
+
+func TestBlockListMatch(t *testing.T) {
+	blocks := blockList{
+		"shady@mlctrez.com":              {},
+		"*@spammy-subdomain.example.com": {},
+		"newsletter-*@mlctrez.com":       {},
+		"@junk.example.org":              {},
+		"spam.example.net":               {},
+	}
+
+	tests := []struct {
+		address  string
+		expected bool
+	}{
+		{"Shady <SHADY@mlctrez.com>", true},
+		{"anyone@spammy-subdomain.example.com", true},
+		{"anyone@example.com", false},
+		{"newsletter-weekly@mlctrez.com", true},
+		{"newsletter@mlctrez.com", false},
+		{"a@junk.example.org", true},
+		{"a@mail.junk.example.org", true},
+		{"a@notjunk.example.org", false},
+		{"a@spam.example.net", true},
+		{"matt@mlctrez.com", false},
+	}
+
+	for _, tc := range tests {
+		if _, got := blocks.match(tc.address); got != tc.expected {
+			t.Errorf("match(%q) = %v; want %v", tc.address, got, tc.expected)
+		}
+	}
+}
+
+func TestCachedBlocks(t *testing.T) {
+	defer func(ttl time.Duration) { blockCacheTTL = ttl }(blockCacheTTL)
+	blockCacheTTL = time.Hour
+
+	var requests []*s3.GetObjectInput
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			requests = append(requests, params)
+			if aws.ToString(params.IfNoneMatch) == `"1"` {
+				return nil, &smithyhttp.ResponseError{Response: &smithyhttp.Response{Response: &http.Response{StatusCode: http.StatusNotModified}}}
+			}
+			return &s3.GetObjectOutput{
+				Body: io.NopCloser(strings.NewReader("shady@mlctrez.com\n")),
+				ETag: aws.String(`"1"`),
+			}, nil
+		},
+	}
+	bucket := aws.String("cache-bucket")
+	defer invalidateBlocks(bucket, blocksKey)
+
+	first := cachedBlocks(context.Background(), mock, bucket, blocksKey)
+	first["added@mlctrez.com"] = blockEntry{}
+	second := cachedBlocks(context.Background(), mock, bucket, blocksKey)
+	if len(requests) != 1 {
+		t.Errorf("expected the cached list to be used within the ttl, got %d requests", len(requests))
+	}
+	if len(second) != 1 {
+		t.Errorf("expected changes to a returned list not to affect the cache, got %v", second)
+	}
+
+	blockCacheTTL = 0
+	third := cachedBlocks(context.Background(), mock, bucket, blocksKey)
+	if len(requests) != 2 || aws.ToString(requests[1].IfNoneMatch) != `"1"` {
+		t.Errorf("expected a conditional revalidation, got %d requests", len(requests))
+	}
+	if _, ok := third["shady@mlctrez.com"]; !ok || len(third) != 1 {
+		t.Errorf("expected the cached list after not modified, got %v", third)
+	}
+}
+
+func TestBlockLine(t *testing.T) {
+	added := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	e := blockEntry{Added: added, Expires: added.Add(30 * 24 * time.Hour), Reason: "block command\tfrom owner@gmail.com"}
+	line := formatBlockLine("spam@mlctrez.com", e)
+	if line != "spam@mlctrez.com\tadded=2026-01-02T03:04:05Z\texpires=2026-02-01T03:04:05Z\treason=block command from owner@gmail.com" {
+		t.Errorf("unexpected line %q", line)
+	}
+	entry, parsed := parseBlockLine(line)
+	e.Reason = "block command from owner@gmail.com"
+	if entry != "spam@mlctrez.com" || parsed != e {
+		t.Errorf("parseBlockLine(%q) = %q, %+v", line, entry, parsed)
+	}
+	if entry, parsed = parseBlockLine(" Spam@mlctrez.com\tbogus\texpires=soon"); entry != "spam@mlctrez.com" || parsed != (blockEntry{}) {
+		t.Errorf("expected invalid fields to be ignored, got %q, %+v", entry, parsed)
+	}
+}
+
+func TestBlockListMatch_Expired(t *testing.T) {
+	blocks := blockList{
+		"old@mlctrez.com":   {Expires: time.Now().Add(-time.Minute)},
+		"@junk.example.org": {Expires: time.Now().Add(-time.Minute)},
+		"new@mlctrez.com":   {Expires: time.Now().Add(time.Hour)},
+	}
+	for address, expected := range map[string]bool{"old@mlctrez.com": false, "a@junk.example.org": false, "new@mlctrez.com": true} {
+		if _, got := blocks.match(address); got != expected {
+			t.Errorf("match(%q) = %v; want %v", address, got, expected)
+		}
+	}
+}
+
+func TestUpdateBlocks_PrunesExpired(t *testing.T) {
+	var putBody string
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := "old@mlctrez.com\texpires=2020-01-01T00:00:00Z\nkept@mlctrez.com\n"
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body)), ETag: aws.String(`"1"`)}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			buf, _ := io.ReadAll(params.Body)
+			putBody = string(buf)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	current := blockList{}
+	updateBlocks(context.Background(), mock, aws.String("bucket"), blocksKey, current, []string{"kept@mlctrez.com"}, blockEntry{})
+	if putBody != "kept@mlctrez.com\n" {
+		t.Errorf("expected the expired entry to be removed, put %q", putBody)
+	}
+	if len(current) != 1 {
+		t.Errorf("unexpected current %v", current)
+	}
+}
+
+func TestUpdateBlocks_KeepsAdded(t *testing.T) {
+	var putBody string
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := "spam@mlctrez.com\tadded=2026-01-02T03:04:05Z\treason=first\n"
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body)), ETag: aws.String(`"1"`)}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			buf, _ := io.ReadAll(params.Body)
+			putBody = string(buf)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+
+	added := time.Now().UTC().Truncate(time.Second)
+	entry := blockEntry{Added: added, Expires: added.Add(24 * time.Hour), Reason: "again"}
+	stored := blockList{}
+	updateBlocks(context.Background(), mock, aws.String("bucket"), blocksKey, stored, []string{"spam@mlctrez.com", "new@mlctrez.com"}, entry)
+	first := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	if e := stored["spam@mlctrez.com"]; !e.Added.Equal(first) || !e.Expires.Equal(entry.Expires) || e.Reason != "again" {
+		t.Errorf("expected the first added time to be kept, put %q", putBody)
+	}
+	if e := stored["new@mlctrez.com"]; !e.Added.Equal(added) {
+		t.Errorf("expected the new entry to be added now, put %q", putBody)
+	}
+}
+
+// recordingS3 returns a client for a local server that accepts every request and records the
+// headers of each, so tests see what the SDK actually sends.
+func recordingS3(t *testing.T) (*s3.Client, *[]http.Header) {
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Clone())
+		w.Header().Set("ETag", `"2"`)
+	}))
+	t.Cleanup(server.Close)
+	client := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(server.URL),
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	})
+	return client, &headers
+}
+
+func TestPutBlocks_Condition(t *testing.T) {
+	client, headers := recordingS3(t)
+	entries := blockList{"spam@mlctrez.com": {}}
+
+	if err := putBlocks(context.Background(), client, aws.String("bucket"), blocksKey, entries, `"1"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := putBlocks(context.Background(), client, aws.String("bucket"), blocksKey, entries, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(*headers) != 2 {
+		t.Fatalf("expected two requests, got %d", len(*headers))
+	}
+	if h := (*headers)[0]; h.Get("If-Match") != `"1"` || h.Get("If-None-Match") != "" {
+		t.Errorf("expected If-Match for a stored list, got %v", h)
+	}
+	if h := (*headers)[1]; h.Get("If-None-Match") != "*" || h.Get("If-Match") != "" {
+		t.Errorf("expected If-None-Match for a missing list, got %v", h)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const commandHelp = `Send commands from your EMAIL_TO address with the command in the subject.
+When COMMAND_TOKEN is configured, include it in the subject or body.
+
+block [ttl] [entries]    add entries to blocks.txt, or the To addresses when no entries are given
+unblock [entries]        remove entries from blocks.txt, or the To addresses when no entries are given
+blocksender [ttl] entries
+                         add entries to senders.txt
+unblocksender entries    remove entries from senders.txt
+blocks                   list blocks.txt and senders.txt
+quarantine               list quarantined messages
+release message-ids      forward quarantined or failed messages and remove them from the bucket
+create [ttl] aliases     register aliases in aliases.json, enabling them again when disabled
+disable aliases          disable registered aliases
+aliases                  list aliases.json
+help                     show this message
+
+Entries are addresses (spam@example.com), glob patterns (*@example.com) or domains (@example.com).
+A ttl such as 12h, 30d or 2w makes blocks and aliases expire after that long.
+Words after the entries of block and blocksender are recorded as the reason.
+Mail to disabled or expired aliases gets ALIAS_POLICY, and is dropped when that is forward.`
+
+const scopedHelp = `Send commands from your address with the command in the subject.
+When COMMAND_TOKEN is configured, include it in the subject or body.
+
+block [ttl] [entries]    add entries to blocks.txt, or the To addresses when no entries are given
+unblock [entries]        remove entries from blocks.txt, or the To addresses when no entries are given
+create [ttl] aliases     register aliases routed to you
+disable aliases          disable registered aliases routed to you
+help                     show this message
+
+Entries are addresses or patterns of the aliases routed to you.
+A ttl such as 12h, 30d or 2w makes blocks and aliases expire after that long.
+Words after the entries of block are recorded as the reason.
+Mail to disabled or expired aliases gets ALIAS_POLICY, and is dropped when that is forward.`
+
+var commandNames = map[string]bool{
+	"block": true, "unblock": true, "blocksender": true, "unblocksender": true, "blocks": true,
+	"quarantine": true, "release": true, "create": true, "disable": true, "aliases": true, "help": true,
+}
+
+// loadCommandVerdicts reads COMMAND_VERDICTS, a comma separated list of the verdicts that must PASS
+// for an email to be accepted from the owner. It defaults to dmarc, use none to disable the check.
+func loadCommandVerdicts() []string {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("COMMAND_VERDICTS")))
+	if value == "" {
+		return []string{"dmarc"}
+	}
+	var verdicts []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != "none" {
+			verdicts = append(verdicts, name)
+		}
+	}
+	return verdicts
+}
+
+// commandOwner returns the owner that sent record, empty when it wasn't sent by an owner. The
+// envelope sender and From header must be the same owner's address or one of its subaddresses,
+// and the receipt must show commandVerdicts passing, since the addresses alone are trivially spoofed.
+func (h *handler) commandOwner(record events.SimpleEmailRecord) string {
+	sesMail := record.SES.Mail
+	owner := h.ownerOf(sesMail.Source)
+	if owner == "" {
+		return ""
+	}
+	for _, from := range sesMail.CommonHeaders.From {
+		if h.ownerOf(from) != owner {
+			return ""
+		}
+	}
+	verdicts := receiptVerdicts(record.SES.Receipt)
+	for _, name := range h.commandVerdicts {
+		if !strings.EqualFold(verdicts[name], "PASS") {
+			log.Printf("rejecting owner email %s: %s verdict is %q", sesMail.MessageID, name, verdicts[name])
+			return ""
+		}
+	}
+	return owner
+}
+
+// hasToken reports whether the command token is among args, removing it, or appears in the body of messageID.
+func (h *handler) hasToken(ctx context.Context, messageID string, args []string) ([]string, bool) {
+	if h.commandToken == "" {
+		return args, true
+	}
+	for i, arg := range args {
+		if arg == h.commandToken {
+			return append(args[:i:i], args[i+1:]...), true
+		}
+	}
+	output, err := h.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: h.bucket, Key: aws.String(messageID)})
+	if err != nil {
+		log.Printf("s3Client.GetObject error for %s: %s", messageID, err)
+		return args, false
+	}
+	defer func() { _ = output.Body.Close() }()
+	body, err := io.ReadAll(io.LimitReader(output.Body, 1<<20))
+	if err != nil {
+		return args, false
+	}
+	return args, strings.Contains(string(body), h.commandToken)
+}
+
+// parseCommand splits a command subject into the lower case command and its arguments.
+func parseCommand(subject string) (command string, args []string) {
+	fields := strings.Fields(subject)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return strings.ToLower(fields[0]), fields[1:]
+}
+
+// ttlUnits are the suffixes of the ttl argument of block, blocksender and create.
+var ttlUnits = map[byte]time.Duration{'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+
+// parseTTL removes the first ttl, such as 30d, from args and returns it, zero when there is none.
+func parseTTL(args []string) (time.Duration, []string) {
+	for i, arg := range args {
+		arg = strings.ToLower(arg)
+		if len(arg) < 2 {
+			continue
+		}
+		unit, ok := ttlUnits[arg[len(arg)-1]]
+		if n, err := strconv.Atoi(arg[:len(arg)-1]); ok && err == nil && n > 0 {
+			return time.Duration(n) * unit, append(args[:i:i], args[i+1:]...)
+		}
+	}
+	return 0, args
+}
+
+// splitReason returns the leading entries and ttl in args, and the words after them as the reason,
+// such as "signed me up" in "block 30d news@example.com signed me up". The reason starts at the
+// first word that is neither an entry, see isBlockEntry, nor a ttl.
+func splitReason(args []string) ([]string, string) {
+	for i, arg := range args {
+		if isBlockEntry(arg) {
+			continue
+		}
+		if ttl, _ := parseTTL([]string{arg}); ttl == 0 {
+			return args[:i], strings.Join(args[i:], " ")
+		}
+	}
+	return args, ""
+}
+
+// newBlockEntry records entries added by command in sesMail, expiring after ttl when it is set.
+// Without a reason the command and its sender are recorded instead.
+func newBlockEntry(sesMail events.SimpleEmailMessage, command string, ttl time.Duration, reason string) blockEntry {
+	if reason == "" {
+		reason = fmt.Sprintf("%s command from %s", command, extractEmail(sesMail.Source))
+	}
+	entry := blockEntry{
+		Added:  time.Now().UTC().Truncate(time.Second),
+		Reason: reason,
+	}
+	if ttl > 0 {
+		entry.Expires = entry.Added.Add(ttl)
+	}
+	return entry
+}
+
+// expiryNote is appended to command confirmations for entries expiring at expires.
+func expiryNote(expires time.Time) string {
+	if expires.IsZero() {
+		return ""
+	}
+	return " until " + expires.UTC().Format("2006-01-02 15:04 MST")
+}
+
+// commandEntries returns the entries given in args, or the destinations other than the owners when
+// there are none. Entries for aliases h doesn't own are left out.
+func (h *handler) commandEntries(sesMail events.SimpleEmailMessage, args []string) []string {
+	entries := make([]string, 0)
+	for _, arg := range args {
+		entries = append(entries, normalizeBlock(arg))
+	}
+	if len(entries) == 0 {
+		for _, dest := range sesMail.Destination {
+			if h.ownerOf(dest) == "" {
+				entries = append(entries, extractEmail(dest))
+			}
+		}
+	}
+	owned := entries[:0]
+	for _, entry := range entries {
+		if h.owns(entry) {
+			owned = append(owned, entry)
+		} else {
+			log.Printf("ignoring %s not routed to %s", entry, h.scope)
+		}
+	}
+	return owned
+}
+
+// command runs the owner command in the subject of sesMail and reports whether it was handled.
+// Emails that are not handled are forwarded as usual.
+func (h *handler) command(ctx context.Context, sesMail events.SimpleEmailMessage) bool {
+	command, args := parseCommand(sesMail.CommonHeaders.Subject)
+	if !commandNames[command] {
+		return false
+	}
+	var ok bool
+	if args, ok = h.hasToken(ctx, sesMail.MessageID, args); !ok {
+		log.Printf("ignoring %s command without token in %s", command, sesMail.MessageID)
+		return false
+	}
+	if h.scope != "" && !scopedCommands[command] {
+		log.Printf("ignoring %s command from route owner %s in %s", command, h.scope, sesMail.MessageID)
+		return false
+	}
+	var ttl time.Duration
+	var reason string
+	switch command {
+	case "block", "blocksender":
+		args, reason = splitReason(args)
+		ttl, args = parseTTL(args)
+	case "create":
+		ttl, args = parseTTL(args)
+	}
+	switch command {
+	case "block":
+		newBlocks := h.commandEntries(sesMail, args)
+		if len(newBlocks) == 0 {
+			return false
+		}
+		entry := newBlockEntry(sesMail, command, ttl, reason)
+		log.Printf("Adding to block list: %v", newBlocks)
+		updateBlocks(ctx, h.s3Client, h.bucket, h.blocksObject(), h.blocks, newBlocks, entry)
+		h.ec.Send(fmt.Sprintf("Added to block list: %v%s", newBlocks, expiryNote(entry.Expires)))
+		return true
+	case "unblock":
+		entries := h.commandEntries(sesMail, args)
+		if len(entries) == 0 {
+			return false
+		}
+		removed := removeBlocks(ctx, h.s3Client, h.bucket, h.blocksObject(), h.blocks, entries)
+		log.Printf("Removed from block list: %v", removed)
+		h.ec.Send(fmt.Sprintf("Removed from block list: %v", removed))
+		return true
+	case "blocksender":
+		newSenders := make([]string, 0)
+		for _, arg := range args {
+			newSenders = append(newSenders, normalizeBlock(arg))
+		}
+		if len(newSenders) == 0 {
+			return false
+		}
+		entry := newBlockEntry(sesMail, command, ttl, reason)
+		log.Printf("Adding to sender block list: %v", newSenders)
+		updateBlocks(ctx, h.s3Client, h.bucket, sendersKey, h.senders, newSenders, entry)
+		h.ec.Send(fmt.Sprintf("Added to sender block list: %v%s", newSenders, expiryNote(entry.Expires)))
+		return true
+	case "unblocksender":
+		if len(args) == 0 {
+			return false
+		}
+		removed := removeBlocks(ctx, h.s3Client, h.bucket, sendersKey, h.senders, args)
+		log.Printf("Removed from sender block list: %v", removed)
+		h.ec.Send(fmt.Sprintf("Removed from sender block list: %v", removed))
+		return true
+	case "blocks":
+		h.ec.Send(fmt.Sprintf("%s:\r\n%s\r\n\r\n%s:\r\n%s", h.blocksObject(),
+			strings.Join(h.blocks.describe(), "\r\n"), sendersKey, strings.Join(h.senders.describe(), "\r\n")))
+		return true
+	case "quarantine":
+		digest, _, err := h.digest(ctx)
+		if err != nil {
+			digest = fmt.Sprintf("quarantine digest err : %s", err)
+		}
+		h.ec.Send(digest)
+		return true
+	case "release":
+		if len(args) == 0 {
+			return false
+		}
+		response := h.releaseAll(ctx, args)
+		message := fmt.Sprintf("Released: %v", response.Released)
+		for id, err := range response.Failed {
+			message += fmt.Sprintf("\r\nrelease %s err : %s", id, err)
+		}
+		h.ec.Send(message)
+		return true
+	case "create", "disable":
+		aliases := h.aliasEntries(args)
+		if len(aliases) == 0 {
+			return false
+		}
+		var expires time.Time
+		if ttl > 0 {
+			expires = time.Now().UTC().Truncate(time.Second).Add(ttl)
+		}
+		var changed []string
+		var err error
+		label := "Registered aliases"
+		if command == "create" {
+			changed, err = h.createAliases(ctx, aliases, false, expires)
+		} else {
+			changed, err = h.disableAliases(ctx, aliases)
+			label = "Disabled aliases"
+		}
+		if err != nil {
+			log.Printf("Error updating %s: %s", aliasesKey, err)
+			h.ec.Send(fmt.Sprintf("%s update err : %s", aliasesKey, err))
+			return true
+		}
+		log.Printf("%s: %v", label, changed)
+		h.ec.Send(fmt.Sprintf("%s: %v%s", label, changed, expiryNote(expires)))
+		return true
+	case "aliases":
+		registry, _, err := readAliases(ctx, h.s3Client, h.bucket)
+		if err != nil {
+			h.ec.Send(fmt.Sprintf("%s err : %s", aliasesKey, err))
+			return true
+		}
+		h.ec.Send(fmt.Sprintf("%s:\r\n%s", aliasesKey, strings.Join(registry.sorted(), "\r\n")))
+		return true
+	case "help":
+		if h.scope != "" {
+			h.ec.Send(scopedHelp)
+			return true
+		}
+		h.ec.Send(commandHelp)
+		return true
+	}
+	return false
+}
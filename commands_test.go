@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func commandHandler(putBody *string) (*handler, *mockNotifier) {
+	ec := &mockNotifier{}
+	stored := map[string]string{
+		blocksKey:  "old@mlctrez.com\nshop@mlctrez.com\n",
+		sendersKey: "@spammer.example.com\n",
+	}
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(stored[aws.ToString(params.Key)]))}, nil
+		},
+		putObjectFunc: func(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+			buf, _ := io.ReadAll(params.Body)
+			*putBody = string(buf)
+			return &s3.PutObjectOutput{}, nil
+		},
+	}
+	return &handler{
+		s3Client: mock,
+		to:       "owner@gmail.com",
+		bucket:   aws.String("bucket"),
+		ec:       ec,
+		blocks:   blockList{"old@mlctrez.com": {}, "shop@mlctrez.com": {}},
+		senders:  blockList{"@spammer.example.com": {}},
+	}, ec
+}
+
+func TestCommand_Unblock(t *testing.T) {
+	var putBody string
+	h, ec := commandHandler(&putBody)
+
+	sesMail := events.SimpleEmailMessage{Destination: []string{"shop@mlctrez.com", "owner@gmail.com"}}
+	sesMail.CommonHeaders.Subject = "Unblock"
+
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected unblock to be handled")
+	}
+	if putBody != "old@mlctrez.com\n" {
+		t.Errorf("put body = %q; want only old@mlctrez.com", putBody)
+	}
+	if len(ec.messages) != 1 || !strings.Contains(ec.messages[0], "shop@mlctrez.com") {
+		t.Errorf("unexpected confirmation %v", ec.messages)
+	}
+}
+
+func TestHandleRecord_UnblockBlockedAlias(t *testing.T) {
+	var putBody string
+	h, ec := commandHandler(&putBody)
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "sender@example.com"
+	record.SES.Mail.Destination = []string{"shop@mlctrez.com"}
+	record.SES.Mail.CommonHeaders.Subject = "unblock"
+
+	if disposition := h.forRecord(context.Background(), record).handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet || putBody != "" {
+		t.Fatalf("expected mail from a stranger to the blocked alias to be blocked, disposition %s put %q", disposition, putBody)
+	}
+
+	record.SES.Mail.Source = "owner@gmail.com"
+	if disposition := h.forRecord(context.Background(), record).handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("disposition = %s; want %s", disposition, events.SimpleEmailStopRuleSet)
+	}
+	if putBody != "old@mlctrez.com\n" {
+		t.Errorf("put body = %q; want only old@mlctrez.com", putBody)
+	}
+	if len(ec.messages) != 1 || !strings.Contains(ec.messages[0], "shop@mlctrez.com") {
+		t.Errorf("unexpected confirmation %v", ec.messages)
+	}
+}
+
+func TestCommand_Blocks(t *testing.T) {
+	var putBody string
+	h, ec := commandHandler(&putBody)
+
+	sesMail := events.SimpleEmailMessage{}
+	sesMail.CommonHeaders.Subject = "blocks"
+
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected blocks to be handled")
+	}
+	if len(ec.messages) != 1 {
+		t.Fatalf("expected one message, got %v", ec.messages)
+	}
+	for _, entry := range []string{"old@mlctrez.com", "shop@mlctrez.com", "@spammer.example.com"} {
+		if !strings.Contains(ec.messages[0], entry) {
+			t.Errorf("expected %s in list. Got:\n%s", entry, ec.messages[0])
+		}
+	}
+}
+
+func TestCommand_Unknown(t *testing.T) {
+	var putBody string
+	h, ec := commandHandler(&putBody)
+
+	sesMail := events.SimpleEmailMessage{}
+	sesMail.CommonHeaders.Subject = "Lunch tomorrow?"
+
+	if h.command(context.Background(), sesMail) {
+		t.Error("expected ordinary subject not to be handled")
+	}
+	if len(ec.messages) != 0 {
+		t.Errorf("unexpected messages %v", ec.messages)
+	}
+}
+
+func TestCommandOwner(t *testing.T) {
+	t.Setenv("COMMAND_VERDICTS", "")
+	h := &handler{to: "owner@gmail.com", commandVerdicts: loadCommandVerdicts()}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.Source = "owner@gmail.com"
+	record.SES.Mail.CommonHeaders.From = []string{"Owner <owner@gmail.com>"}
+
+	record.SES.Receipt.DMARCVerdict.Status = "FAIL"
+	if h.commandOwner(record) != "" {
+		t.Error("expected spoofed owner email with failing DMARC to be rejected")
+	}
+
+	record.SES.Receipt.DMARCVerdict.Status = "PASS"
+	if got := h.commandOwner(record); got != "owner@gmail.com" {
+		t.Error("expected owner email with passing DMARC to be accepted")
+	}
+
+	record.SES.Mail.CommonHeaders.From = []string{"someone@example.com"}
+	if h.commandOwner(record) != "" {
+		t.Error("expected email with another From address to be rejected")
+	}
+}
+
+func TestCommand_Token(t *testing.T) {
+	var putBody string
+	h, _ := commandHandler(&putBody)
+	h.commandToken = "s3cret"
+	getStored := h.s3Client.(*mockS3).getObjectFunc
+	h.s3Client.(*mockS3).getObjectFunc = func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+		if aws.ToString(params.Key) == "message-id" {
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("Subject: block\n\nno token here\n"))}, nil
+		}
+		return getStored(ctx, params, optFns...)
+	}
+
+	sesMail := events.SimpleEmailMessage{MessageID: "message-id"}
+	sesMail.CommonHeaders.Subject = "block spam@example.com"
+	if h.command(context.Background(), sesMail) {
+		t.Error("expected command without token to be ignored")
+	}
+
+	sesMail.CommonHeaders.Subject = "block s3cret spam@example.com"
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected command with token to be handled")
+	}
+	if strings.Contains(putBody, "s3cret") || !strings.Contains(putBody, "spam@example.com") {
+		t.Errorf("unexpected put body %q", putBody)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	command, args := parseCommand(" Block *@Spammy.example.com  @junk.example.org")
+	if command != "block" {
+		t.Errorf("command = %q; want block", command)
+	}
+	if len(args) != 2 || normalizeBlock(args[0]) != "*@spammy.example.com" || args[1] != "@junk.example.org" {
+		t.Errorf("unexpected args %v", args)
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	ttl, args := parseTTL([]string{"spam@example.com", "30D", "2w"})
+	if ttl != 30*24*time.Hour || len(args) != 2 || args[0] != "spam@example.com" || args[1] != "2w" {
+		t.Errorf("parseTTL = %s, %v", ttl, args)
+	}
+	for _, arg := range []string{"d", "0d", "5m", "30days", "@30d.example.com"} {
+		if ttl, _ = parseTTL([]string{arg}); ttl != 0 {
+			t.Errorf("expected no ttl in %q, got %s", arg, ttl)
+		}
+	}
+}
+
+func TestCommand_BlockTTL(t *testing.T) {
+	var putBody string
+	h, ec := commandHandler(&putBody)
+
+	sesMail := events.SimpleEmailMessage{MessageID: "message-id", Source: "owner@gmail.com"}
+	sesMail.CommonHeaders.Subject = "block 30d spam@example.com"
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected block command to be handled")
+	}
+	var line string
+	for _, l := range strings.Split(putBody, "\n") {
+		if strings.HasPrefix(l, "spam@example.com\t") {
+			line = l
+		}
+	}
+	entry, e := parseBlockLine(line)
+	if entry != "spam@example.com" || e.Reason != "block command from owner@gmail.com" || e.Expires.Sub(e.Added) != 30*24*time.Hour {
+		t.Errorf("unexpected line %q in %q", line, putBody)
+	}
+	if len(ec.messages) != 1 || !strings.Contains(ec.messages[0], "[spam@example.com] until ") {
+		t.Errorf("unexpected messages %v", ec.messages)
+	}
+}
+
+func TestCommand_BlockReason(t *testing.T) {
+	var putBody string
+	h, _ := commandHandler(&putBody)
+
+	sesMail := events.SimpleEmailMessage{MessageID: "message-id", Source: "owner@gmail.com"}
+	sesMail.CommonHeaders.Subject = "blocksender news@example.com 2w signed me up without asking"
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected blocksender command to be handled")
+	}
+	var line string
+	for _, l := range strings.Split(putBody, "\n") {
+		if strings.HasPrefix(l, "news@example.com\t") {
+			line = l
+		}
+	}
+	entry, e := parseBlockLine(line)
+	if entry != "news@example.com" || e.Reason != "signed me up without asking" || e.Expires.Sub(e.Added) != 14*24*time.Hour {
+		t.Errorf("unexpected line %q in %q", line, putBody)
+	}
+}
+
+func TestCommand_BlockDomain(t *testing.T) {
+	var putBody string
+	h, ec := commandHandler(&putBody)
+
+	sesMail := events.SimpleEmailMessage{MessageID: "message-id", Source: "owner@gmail.com", Destination: []string{"shop@mlctrez.com"}}
+	sesMail.CommonHeaders.Subject = "block Spammy.example.com"
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected block command to be handled")
+	}
+	if !strings.Contains(putBody, "spammy.example.com\tadded=") || strings.Contains(putBody, "reason=spammy") {
+		t.Errorf("expected the bare domain to be blocked, put %q", putBody)
+	}
+
+	sesMail.CommonHeaders.Subject = "blocksender spammer.example.org 1w bulk mail"
+	if !h.command(context.Background(), sesMail) {
+		t.Fatal("expected blocksender command to be handled")
+	}
+	var line string
+	for _, l := range strings.Split(putBody, "\n") {
+		if strings.HasPrefix(l, "spammer.example.org\t") {
+			line = l
+		}
+	}
+	if _, e := parseBlockLine(line); e.Reason != "bulk mail" || e.Expires.IsZero() {
+		t.Errorf("unexpected line %q in %q", line, putBody)
+	}
+	if len(ec.messages) != 2 || !strings.HasPrefix(ec.messages[1], "Added to sender block list: [spammer.example.org] until ") {
+		t.Errorf("unexpected messages %v", ec.messages)
+	}
+}
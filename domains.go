@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// domainSettings replace the defaults from the environment for mail received on a domain.
+// Empty settings keep the default.
+type domainSettings struct {
+	// From is the verified address mail is forwarded from, instead of EMAIL_FROM
+	From string `json:"from,omitempty"`
+	// To is the mailbox mail is forwarded to and commands are accepted from, instead of EMAIL_TO
+	To string `json:"to,omitempty"`
+	// Blocks is the key of the recipient blocklist in the bucket, instead of blocks.txt
+	Blocks string `json:"blocks,omitempty"`
+	// HeaderRules is a JSON list of rules or the key of a JSON object holding them, instead of HEADER_RULES
+	HeaderRules json.RawMessage `json:"header_rules,omitempty"`
+	// Routes are tried before those of ROUTES. The catch-all of ROUTES is skipped when To is set or
+	// Routes has its own.
+	Routes routeTable `json:"routes,omitempty"`
+}
+
+// domainTable maps lower case domains to their settings.
+type domainTable map[string]domainSettings
+
+// parseDomains reads a JSON object of domain settings, such as
+//
+//	{"example.com": {"from": "forwarder@example.com", "to": "me@gmail.com", "blocks": "example.com/blocks.txt"}}
+func parseDomains(data []byte) (domainTable, error) {
+	var raw map[string]domainSettings
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	domains := make(domainTable, len(raw))
+	for domain, settings := range raw {
+		domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(domain)), "@")
+		if domain == "" {
+			return nil, fmt.Errorf("settings without a domain")
+		}
+		if settings.To != "" {
+			if settings.To = extractEmail(settings.To); !strings.Contains(settings.To, "@") {
+				return nil, fmt.Errorf("invalid to for %s", domain)
+			}
+		}
+		if err := settings.Routes.normalize(); err != nil {
+			return nil, fmt.Errorf("routes for %s: %w", domain, err)
+		}
+		domains[domain] = settings
+	}
+	return domains, nil
+}
+
+// lookup returns the settings for domain, or else for the closest parent domain that has them.
+func (t domainTable) lookup(domain string) (domainSettings, bool) {
+	domain = strings.ToLower(domain)
+	for domain != "" {
+		if settings, ok := t[domain]; ok {
+			return settings, true
+		}
+		_, domain, _ = strings.Cut(domain, ".")
+	}
+	return domainSettings{}, false
+}
+
+// loadDomains reads DOMAINS, either a JSON object of domain settings or the key of a JSON object
+// in the bucket holding them. Without it every domain uses the defaults.
+func loadDomains(ctx context.Context, client s3API, bucket *string, ec notifier) domainTable {
+	value := strings.TrimSpace(os.Getenv("DOMAINS"))
+	parse := func(data []byte, source string) interface{} {
+		domains, err := parseDomains(data)
+		if err != nil {
+			log.Printf("ignoring invalid domains in %s: %s", source, err)
+			ec.Send(fmt.Sprintf("ignoring invalid domains in %s : %s", source, err))
+			return domainTable(nil)
+		}
+		return domains
+	}
+	switch {
+	case value == "":
+		return nil
+	case strings.HasPrefix(value, "{"):
+		return parse([]byte(value), "DOMAINS").(domainTable)
+	}
+	domains, _ := cachedObject(ctx, client, bucket, value, parse, domainTable(nil))
+	return domains.(domainTable)
+}
+
+// forRecord returns h with the settings of the domain record was received on, the domain of its
+// first recipient that isn't a reply address.
+func (h *handler) forRecord(ctx context.Context, record events.SimpleEmailRecord) *handler {
+	for _, dest := range record.SES.Mail.Destination {
+		if _, ok := parseReplyAddress(dest, h.replyDomain); h.replyDomain == "" || !ok {
+			return h.forDomain(ctx, dest)
+		}
+	}
+	return h
+}
+
+// forDomain returns the handler built from the environment with the settings of the domain of
+// alias, that handler itself when the domain has none.
+func (h *handler) forDomain(ctx context.Context, alias string) *handler {
+	if h.base != nil {
+		h = h.base
+	}
+	_, domain, _ := strings.Cut(extractEmail(alias), "@")
+	settings, ok := h.domains.lookup(domain)
+	if !ok {
+		return h
+	}
+	d := *h
+	d.base = h
+	if settings.From != "" {
+		d.from = settings.From
+	}
+	if settings.To != "" {
+		d.to = settings.To
+	}
+	if (d.from != h.from || d.to != h.to) && h.notifierFor != nil {
+		d.ec = h.notifierFor(d.from, d.to)
+	}
+	if settings.To != "" || settings.Routes.hasCatchAll() {
+		d.routes = append(settings.Routes[:len(settings.Routes):len(settings.Routes)], h.routes.withoutCatchAll()...)
+	} else if len(settings.Routes) > 0 {
+		d.routes = append(settings.Routes[:len(settings.Routes):len(settings.Routes)], h.routes...)
+	}
+	if settings.Blocks != "" {
+		d.blocksFile = settings.Blocks
+		d.blocks = cachedBlocks(ctx, d.s3Client, d.bucket, settings.Blocks)
+	}
+	if len(settings.HeaderRules) > 0 {
+		value := strings.TrimSpace(string(settings.HeaderRules))
+		var key string
+		if json.Unmarshal(settings.HeaderRules, &key) == nil {
+			value = strings.TrimSpace(key)
+		}
+		d.headerRules = headerRules(ctx, d.s3Client, d.bucket, value, "header_rules for "+domain, d.ec)
+	}
+	return &d
+}
+
+// blocksObject is the key of the recipient blocklist of h, blocksKey unless a domain sets another.
+func (h *handler) blocksObject() string {
+	if h.blocksFile == "" {
+		return blocksKey
+	}
+	return h.blocksFile
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const testDomains = `{
+	"Family.example": {"from": "forwarder@family.example", "to": "Mom <mom@example.net>", "blocks": "family/blocks.txt"},
+	"@ops.example": {"header_rules": [{"name": "Subject", "action": "set", "value": "[ops] {{.Value}}"}]}
+}`
+
+func TestParseDomains(t *testing.T) {
+	domains, err := parseDomains([]byte(testDomains))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings, ok := domains.lookup("mail.family.example"); !ok || settings.To != "mom@example.net" {
+		t.Errorf("expected the parent domain settings for a subdomain, got %+v", settings)
+	}
+	if _, ok := domains.lookup("example"); ok {
+		t.Error("expected no settings for an unconfigured domain")
+	}
+	if _, err = parseDomains([]byte(`{"family.example": {"to": "nobody"}}`)); err == nil {
+		t.Error("expected an error for an invalid to")
+	}
+}
+
+func TestHandleRecord_Domains(t *testing.T) {
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := "From: sender@example.com\r\nTo: school@family.example\r\nSubject: Trip\r\n\r\nbody\r\n"
+			if aws.ToString(params.Key) == "family/blocks.txt" {
+				body = "spam@family.example\n"
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	domains, _ := parseDomains([]byte(testDomains))
+	h := &handler{
+		s3Client:  mock,
+		sesClient: sesMock,
+		bucket:    aws.String("domains-bucket"),
+		from:      "forwarder@mlctrez.com",
+		to:        "owner@gmail.com",
+		ec:        &mockNotifier{},
+		domains:   domains,
+	}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "sender@example.com"
+	record.SES.Mail.Destination = []string{"school@family.example"}
+
+	h.forRecord(context.Background(), record).handleRecord(context.Background(), record)
+	if len(sesMock.sent) != 1 {
+		t.Fatalf("expected one message to be sent, got %d", len(sesMock.sent))
+	}
+	if sent := sesMock.sent[0]; aws.ToString(sent.Source) != "forwarder@family.example" || sent.Destinations[0] != "mom@example.net" {
+		t.Errorf("expected the domain identity and destination, got %s to %v", aws.ToString(sent.Source), sent.Destinations)
+	}
+
+	record.SES.Mail.Destination = []string{"spam@family.example"}
+	if disposition := h.forRecord(context.Background(), record).handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("expected the domain blocklist to apply, disposition %s", disposition)
+	}
+
+	record.SES.Mail.Destination = []string{"alerts@ops.example"}
+	h.forRecord(context.Background(), record).handleRecord(context.Background(), record)
+	if len(sesMock.sent) != 2 {
+		t.Fatalf("expected a second message to be sent, got %d", len(sesMock.sent))
+	}
+	sent := sesMock.sent[1]
+	if aws.ToString(sent.Source) != "forwarder@mlctrez.com" || !strings.Contains(string(sent.RawMessage.Data), "Subject: [ops] Trip") {
+		t.Errorf("expected the default identity with the domain header rules, got\n%s", sent.RawMessage.Data)
+	}
+}
+
+func TestForDomain_Routes(t *testing.T) {
+	routes, _ := parseRoutes([]byte(testRoutes))
+	domains, err := parseDomains([]byte(`{
+		"family.example": {"to": "mom@example.net"},
+		"ops.example": {"routes": [{"match": "Pager@ops.example", "to": ["oncall@example.net"]}]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handler{to: "owner@gmail.com", routes: routes, domains: domains}
+
+	for alias, expected := range map[string]string{
+		"school@family.example":  "mom@example.net",
+		"pager@ops.example":      "oncall@example.net",
+		"deploy@ops.example":     "owner@gmail.com",
+		"deploy@ops.mlctrez.com": "alice@example.net",
+	} {
+		if to := h.forDomain(context.Background(), alias).destinations(alias); to[0] != expected {
+			t.Errorf("destinations(%q) = %v; want %s", alias, to, expected)
+		}
+	}
+}
+
+func TestHandleRecord_DomainDeliveries(t *testing.T) {
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := "From: sender@example.com\r\nTo: school@family.example, shop@mlctrez.com\r\nSubject: Trip\r\n\r\nbody\r\n"
+			if aws.ToString(params.Key) == "family/blocks.txt" {
+				body = "spam@family.example\n"
+			}
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	domains, _ := parseDomains([]byte(testDomains))
+	h := &handler{
+		s3Client:  mock,
+		sesClient: sesMock,
+		bucket:    aws.String("deliveries-bucket"),
+		from:      "forwarder@mlctrez.com",
+		to:        "owner@gmail.com",
+		ec:        &mockNotifier{},
+		domains:   domains,
+	}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "sender@example.com"
+	record.SES.Mail.Destination = []string{"shop@mlctrez.com", "school@family.example"}
+
+	h.forRecord(context.Background(), record).handleRecord(context.Background(), record)
+	if len(sesMock.sent) != 2 {
+		t.Fatalf("expected one message per domain, got %d", len(sesMock.sent))
+	}
+	for i, expected := range [][2]string{{"forwarder@mlctrez.com", "owner@gmail.com"}, {"forwarder@family.example", "mom@example.net"}} {
+		if sent := sesMock.sent[i]; aws.ToString(sent.Source) != expected[0] || sent.Destinations[0] != expected[1] {
+			t.Errorf("message %d sent from %s to %v; want %v", i, aws.ToString(sent.Source), sent.Destinations, expected)
+		}
+	}
+
+	record.SES.Mail.Destination = []string{"shop@mlctrez.com", "spam@family.example"}
+	if disposition := h.forRecord(context.Background(), record).handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("expected the blocklist of the second recipient's domain to apply, disposition %s", disposition)
+	}
+}
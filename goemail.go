@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"net/mail"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
@@ -24,6 +28,17 @@ type s3API interface {
 	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
 	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
 	DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+	CopyObject(ctx context.Context, params *s3.CopyObjectInput, optFns ...func(*s3.Options)) (*s3.CopyObjectOutput, error)
+	HeadObject(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error)
+	ListObjectsV2(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error)
+}
+
+type presignAPI interface {
+	PresignGetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error)
+}
+
+type sesAPI interface {
+	SendRawEmail(ctx context.Context, params *ses.SendRawEmailInput, optFns ...func(*ses.Options)) (*ses.SendRawEmailOutput, error)
 }
 
 func extractEmail(address string) string {
@@ -35,168 +50,408 @@ func extractEmail(address string) string {
 }
 
 func main() {
-	lambda.Start(Handle)
+	lambda.Start(Invoke)
+}
+
+// Invoke dispatches scheduled EventBridge events to Digest, {"release": [...]} payloads
+// to Release and everything else to Handle.
+func Invoke(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var probe struct {
+		Source  string   `json:"source"`
+		Release []string `json:"release"`
+	}
+	if err := json.Unmarshal(payload, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Source == "aws.events" {
+		return nil, Digest(ctx)
+	}
+	if len(probe.Release) > 0 {
+		return Release(ctx, probe.Release...), nil
+	}
+	var event events.SimpleEmailEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return Handle(ctx, event)
 }
 
+var (
+	clientsOnce  sync.Once
+	cachedS3     *s3.Client
+	cachedSES    *ses.Client
+	cachedConfig error
+)
+
+// clients builds the AWS clients once per Lambda instance so warm invocations reuse them.
 func clients(ctx context.Context) (s3Client *s3.Client, sesClient *ses.Client) {
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1"))
-	if err != nil {
-		log.Fatal(err)
+	clientsOnce.Do(func() {
+		var cfg aws.Config
+		if cfg, cachedConfig = config.LoadDefaultConfig(ctx, config.WithRegion("us-east-1")); cachedConfig != nil {
+			return
+		}
+		cachedS3, cachedSES = s3.NewFromConfig(cfg), ses.NewFromConfig(cfg)
+	})
+	if cachedConfig != nil {
+		log.Fatal(cachedConfig)
 	}
-	return s3.NewFromConfig(cfg), ses.NewFromConfig(cfg)
+	return cachedS3, cachedSES
 }
 
-func Handle(ctx context.Context, event events.SimpleEmailEvent) (response interface{}, err error) {
+// notifier sends administrative messages to the owner.
+type notifier interface {
+	Send(message string)
+}
+
+type handler struct {
+	s3Client  s3API
+	presigner presignAPI
+	sesClient sesAPI
+	from      string
+	to        string
+	bucket    *string
+	ec        notifier
+	blocks    blockList
+	senders   blockList
+	policy    verdictPolicy
+	// replyDomain enables reply addresses on this domain when set
+	replyDomain string
+	// commandVerdicts must all PASS for an email to be accepted from the owner
+	commandVerdicts []string
+	// commandToken, when set, must appear in the subject or body of owner commands
+	commandToken string
+	// blockAction is actionDrop or actionQuarantine for blocked emails
+	blockAction verdictAction
+	// offloadLimit, when set, is the size above which attachments are moved to the bucket
+	offloadLimit int
+	// preserveBody forwards message bodies byte for byte, only rewriting the header block
+	preserveBody bool
+	// headerRules rewrite the header fields of forwarded messages, the defaults when nil
+	headerRules sesutil.HeaderRules
+	// fromName is the display name template for From, sesutil.DefaultFromName when nil
+	fromName *template.Template
+	// subjectTag, when set, labels the subject of forwarded messages with the alias
+	subjectTag *sesutil.SubjectTag
+	// plusAddress forwards to a subaddress of the destinations named after the alias, see destinations
+	plusAddress bool
+	// routes deliver aliases to other mailboxes than to, see routeFor
+	routes routeTable
+	// scope, when set, is the route owner commands are run for, see scoped
+	scope string
+	// notifierFor returns a notifier sending from and to other addresses than ec
+	notifierFor func(from, to string) notifier
+	// domains hold the settings that replace the defaults for mail received on a domain, see forDomain
+	domains domainTable
+	// blocksFile is the key of the recipient blocklist, see blocksObject
+	blocksFile string
+	// aliasPolicy is the action for emails to unregistered aliases, actionForward to accept any alias
+	aliasPolicy verdictAction
+	// learnAliases registers aliases when the owner replies from them
+	learnAliases bool
+	// aliases is the alias registry, nil when there is none
+	aliases aliasRegistry
+	// base is the handler forDomain derived h from, nil for the handler built from the environment
+	base *handler
+}
+
+// newHandler builds a handler from the environment, without loading the blocklists.
+func newHandler(ctx context.Context) *handler {
 	s3Client, sesClient := clients(ctx)
 
-	if len(event.Records) == 0 {
-		return nil, nil
+	h := &handler{
+		s3Client:  s3Client,
+		presigner: s3.NewPresignClient(s3Client, s3.WithPresignExpires(time.Second*604800)),
+		sesClient: sesClient,
+		from:      os.Getenv("EMAIL_FROM"),
+		to:        extractEmail(os.Getenv("EMAIL_TO")),
+		bucket:    aws.String(os.Getenv("EMAIL_BUCKET")),
+		policy:    loadVerdictPolicy(),
+
+		replyDomain:     strings.ToLower(os.Getenv("REPLY_DOMAIN")),
+		commandVerdicts: loadCommandVerdicts(),
+		commandToken:    os.Getenv("COMMAND_TOKEN"),
+		blockAction:     loadBlockAction(),
+		offloadLimit:    loadOffloadLimit(),
+		preserveBody:    loadPreserveBody(),
+		fromName:        loadFromName(),
+		subjectTag:      loadSubjectTag(),
+		plusAddress:     loadPlusAddress(),
+		aliasPolicy:     loadAliasPolicy(),
+		learnAliases:    loadLearnAliases(),
+	}
+	h.ec = sesutil.EmailContext(sesClient, h.from, h.to)
+	h.notifierFor = func(from, to string) notifier { return sesutil.EmailContext(sesClient, from, to) }
+	h.headerRules = loadHeaderRules(ctx, s3Client, h.bucket, h.ec)
+	h.routes = loadRoutes(ctx, s3Client, h.bucket, h.ec)
+	h.domains = loadDomains(ctx, s3Client, h.bucket, h.ec)
+	return h
+}
+
+// loadPreserveBody reads PRESERVE_BODY, false when unset.
+func loadPreserveBody() bool {
+	value := strings.TrimSpace(os.Getenv("PRESERVE_BODY"))
+	if value == "" {
+		return false
+	}
+	preserve, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("ignoring invalid PRESERVE_BODY %q", value)
 	}
+	return preserve
+}
 
-	from := os.Getenv("EMAIL_FROM")
-	to := extractEmail(os.Getenv("EMAIL_TO"))
-	bucket := aws.String(os.Getenv("EMAIL_BUCKET"))
+// Handle processes the SES event and returns a disposition for the receipt rule set. Each record
+// is handled with the settings of the domain it was received on.
+// STOP_RULE_SET is returned when any record was blocked, dropped, quarantined or consumed
+// as a command so that later receipt rule actions do not fire on it.
+func Handle(ctx context.Context, event events.SimpleEmailEvent) (events.SimpleEmailDisposition, error) {
+	response := events.SimpleEmailDisposition{Disposition: events.SimpleEmailContinue}
+	if len(event.Records) == 0 {
+		return response, nil
+	}
 
-	ec := sesutil.EmailContext(sesClient, from, to)
-	blocks := getBlocks(ctx, s3Client, bucket)
+	h := newHandler(ctx)
+	h.blocks = cachedBlocks(ctx, h.s3Client, h.bucket, blocksKey)
+	h.senders = cachedBlocks(ctx, h.s3Client, h.bucket, sendersKey)
+	h.aliases = cachedAliases(ctx, h.s3Client, h.bucket, h.ec)
 
 	for _, record := range event.Records {
-		sesMail := record.SES.Mail
+		if h.forRecord(ctx, record).handleRecord(ctx, record) == events.SimpleEmailStopRuleSet {
+			response.Disposition = events.SimpleEmailStopRuleSet
+		}
+	}
 
-		isBlocked := false
-		for _, dest := range sesMail.Destination {
-			if _, ok := blocks[extractEmail(dest)]; ok {
-				isBlocked = true
-				break
-			}
+	return response, nil
+}
+
+func (h *handler) handleRecord(ctx context.Context, record events.SimpleEmailRecord) events.SimpleEmailDispositionValue {
+	sesMail := record.SES.Mail
+
+	// Mail from a verified owner skips the blocklists, so that commands such as unblock reach a blocked alias
+	owner := h.commandOwner(record)
+
+	if blockReason := h.blockReason(ctx, sesMail); owner == "" && blockReason != "" {
+		log.Printf("Blocking %s, %s", sesMail.MessageID, blockReason)
+		if h.blockAction == actionQuarantine {
+			h.quarantine(ctx, sesMail, blockReason)
+		} else if errDel := deleteObject(ctx, h.s3Client, h.bucket, sesMail.MessageID); errDel != nil {
+			log.Printf("s3Client.DeleteObjects error for blocked sesMail %s: %s", sesMail.MessageID, errDel)
 		}
+		return events.SimpleEmailStopRuleSet
+	}
 
-		if isBlocked {
-			log.Printf("Blocking email to %v", sesMail.Destination)
-			_, errDel := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-				Bucket: bucket,
-				Delete: &s3Types.Delete{
-					Objects: []s3Types.ObjectIdentifier{{Key: aws.String(sesMail.MessageID)}},
-				},
-			})
-			if errDel != nil {
-				log.Printf("s3Client.DeleteObjects error for blocked sesMail %s: %s", sesMail.MessageID, errDel)
-			}
-			continue
+	var extraHeaders []string
+	action, failed := h.policy.evaluate(record.SES.Receipt)
+	switch action {
+	case actionDrop:
+		log.Printf("Dropping %s for failed verdicts %v", sesMail.MessageID, failed)
+		if errDel := deleteObject(ctx, h.s3Client, h.bucket, sesMail.MessageID); errDel != nil {
+			log.Printf("s3Client.DeleteObjects error for dropped sesMail %s: %s", sesMail.MessageID, errDel)
 		}
+		return events.SimpleEmailStopRuleSet
+	case actionQuarantine:
+		log.Printf("Quarantining %s for failed verdicts %v", sesMail.MessageID, failed)
+		h.quarantine(ctx, sesMail, "verdict: "+strings.Join(failed, ", "))
+		return events.SimpleEmailStopRuleSet
+	case actionTag:
+		extraHeaders = append(extraHeaders, fmt.Sprintf("%s: %s", verdictHeader, strings.Join(failed, ", ")))
+	}
 
-		if strings.ToLower(sesMail.CommonHeaders.Subject) == "block" {
-			isFromOwner := false
-			if extractEmail(sesMail.Source) == to {
-				isFromOwner = true
-			}
-			if isFromOwner {
-				newBlocks := make([]string, 0)
-				for _, dest := range sesMail.Destination {
-					destEmail := extractEmail(dest)
-					if destEmail != to {
-						newBlocks = append(newBlocks, destEmail)
-					}
-				}
-				if len(newBlocks) > 0 {
-					log.Printf("Adding to block list: %v", newBlocks)
-					updateBlocks(ctx, s3Client, bucket, blocks, newBlocks)
-					ec.Send(fmt.Sprintf("Added to block list: %v", newBlocks))
-					// Also delete the command email
-					_, _ = s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-						Bucket: bucket,
-						Delete: &s3Types.Delete{
-							Objects: []s3Types.ObjectIdentifier{{Key: aws.String(sesMail.MessageID)}},
-						},
-					})
-					continue
-				}
+	if id, ok := h.replyTarget(sesMail); ok && owner != "" {
+		h.scoped(owner).reply(ctx, sesMail, id)
+		return events.SimpleEmailStopRuleSet
+	}
+
+	if action, unknown := h.aliasAction(sesMail); owner == "" && len(unknown) > 0 {
+		reason := "unregistered: to " + strings.Join(unknown, ", ")
+		switch action {
+		case actionDrop:
+			log.Printf("Dropping %s, %s", sesMail.MessageID, reason)
+			if errDel := deleteObject(ctx, h.s3Client, h.bucket, sesMail.MessageID); errDel != nil {
+				log.Printf("s3Client.DeleteObjects error for dropped sesMail %s: %s", sesMail.MessageID, errDel)
 			}
+			return events.SimpleEmailStopRuleSet
+		case actionQuarantine:
+			log.Printf("Quarantining %s, %s", sesMail.MessageID, reason)
+			h.quarantine(ctx, sesMail, reason)
+			return events.SimpleEmailStopRuleSet
+		case actionTag:
+			extraHeaders = append(extraHeaders, fmt.Sprintf("%s: %s", aliasHeader, strings.Join(unknown, ", ")))
 		}
+	}
 
-		getObjectInput := &s3.GetObjectInput{Bucket: bucket, Key: aws.String(sesMail.MessageID)}
+	if owner != "" && h.scoped(owner).command(ctx, sesMail) {
+		// Also delete the command email
+		_ = deleteObject(ctx, h.s3Client, h.bucket, sesMail.MessageID)
+		return events.SimpleEmailStopRuleSet
+	}
 
-		var getObjectOutput *s3.GetObjectOutput
-		getObjectOutput, err = s3Client.GetObject(ctx, getObjectInput)
+	if h.replyDomain != "" {
+		header, err := h.replyHeader(ctx, sesMail)
 		if err != nil {
-			log.Printf("s3Client.GetObject error for %s: %s", sesMail.MessageID, err)
-			ec.Send(fmt.Sprintf("s3Client.GetObject err : %s", err))
-			continue
+			log.Printf("replyHeader error for %s: %s", sesMail.MessageID, err)
+		} else {
+			extraHeaders = append(extraHeaders, header)
 		}
+	}
 
-		_, err = sesClient.SendRawEmail(ctx, &ses.SendRawEmailInput{
-			RawMessage:   sesutil.Process(getObjectOutput.Body, from, to),
-			Source:       &from,
-			Destinations: []string{to},
-		})
-		if err != nil {
-			log.Printf("sesClient.SendRawEmail error for %s: %s", sesMail.MessageID, err)
-			psClient := s3.NewPresignClient(s3Client, s3.WithPresignExpires(time.Second*604800))
-			psReq, psErr := psClient.PresignGetObject(ctx, getObjectInput)
-			if psErr != nil {
-				ec.Send(fmt.Sprintf("PresignGetObject err : %s", psErr))
-				continue
-			}
-			ec.Send(fmt.Sprintf("RawEmail %s \r\nSendRawEmail err : %s", psReq.URL, err))
-			continue
-		} else {
-			_, errDel := s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
-				Bucket: bucket,
-				Delete: &s3Types.Delete{
-					Objects: []s3Types.ObjectIdentifier{{Key: getObjectInput.Key}},
-				},
-			})
-			if errDel != nil {
-				log.Printf("s3Client.DeleteObjects error for %s: %s", sesMail.MessageID, errDel)
-				ec.Send(fmt.Sprintf("DeleteObjects err : %s", errDel))
-				continue
+	_ = h.forward(ctx, sesMail.MessageID, sesMail.Destination, extraHeaders)
+	return events.SimpleEmailContinue
+}
+
+// blockReason describes the first recipient or sender of sesMail that is blocked, empty when none is.
+// Each recipient is checked against the blocklist of its domain.
+func (h *handler) blockReason(ctx context.Context, sesMail events.SimpleEmailMessage) string {
+	for _, dest := range sesMail.Destination {
+		if entry, ok := h.forDomain(ctx, dest).blocks.match(dest); ok {
+			return fmt.Sprintf("blocked: to %s matching %s", extractEmail(dest), entry)
+		}
+	}
+	for _, sender := range append([]string{sesMail.Source}, sesMail.CommonHeaders.From...) {
+		if entry, ok := h.senders.match(sender); ok {
+			return fmt.Sprintf("blocked: from %s matching %s", extractEmail(sender), entry)
+		}
+	}
+	return ""
+}
+
+// forward sends the stored message for messageID, received at aliases, to the mailboxes they are
+// routed to and removes it from the bucket. Without aliases it goes to the catch-all route and the
+// first original To address is used as the alias. Every delivery is attempted. Failures are reported
+// through the notifier and leave the object in place, with the aliases of the failed deliveries in
+// its metadata so that releasing it retries only those.
+func (h *handler) forward(ctx context.Context, messageID string, aliases []string, extraHeaders []string) error {
+	var failed []string
+	var firstErr error
+	for _, d := range h.deliveries(ctx, aliases) {
+		if err := d.handler.deliver(ctx, messageID, d, extraHeaders); err != nil {
+			failed = append(failed, d.aliases...)
+			if firstErr == nil {
+				firstErr = err
 			}
 		}
 	}
+	if firstErr != nil {
+		h.keepFailed(ctx, messageID, failed)
+		return firstErr
+	}
 
-	return nil, nil
+	if errDel := deleteObject(ctx, h.s3Client, h.bucket, messageID); errDel != nil {
+		log.Printf("s3Client.DeleteObjects error for %s: %s", messageID, errDel)
+		h.ec.Send(fmt.Sprintf("DeleteObjects err : %s", errDel))
+	}
+	return nil
 }
 
-const blocksKey = "blocks.txt"
+// deliver sends one copy of the stored message for messageID to the mailboxes of d.
+func (h *handler) deliver(ctx context.Context, messageID string, d delivery, extraHeaders []string) error {
+	getObjectInput := &s3.GetObjectInput{Bucket: h.bucket, Key: aws.String(messageID)}
 
-func getBlocks(ctx context.Context, client s3API, bucket *string) map[string]struct{} {
-	res := make(map[string]struct{})
-	output, err := client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: bucket,
-		Key:    aws.String(blocksKey),
-	})
+	getObjectOutput, err := h.s3Client.GetObject(ctx, getObjectInput)
 	if err != nil {
-		return res
+		log.Printf("s3Client.GetObject error for %s: %s", messageID, err)
+		h.ec.Send(fmt.Sprintf("s3Client.GetObject err : %s", err))
+		return err
 	}
-	defer func() { _ = output.Body.Close() }()
-	body, err := io.ReadAll(output.Body)
+	defer func() { _ = getObjectOutput.Body.Close() }()
+
+	rawMessage, err := sesutil.Forward{
+		From:         h.from,
+		To:           strings.Join(d.to, ", "),
+		Alias:        d.alias,
+		FromName:     h.fromName,
+		Rules:        h.headerRules,
+		ExtraHeaders: extraHeaders,
+		Preserve:     h.preserveBody,
+		SubjectTag:   h.subjectTag,
+	}.Process(getObjectOutput.Body)
 	if err != nil {
-		return res
+		log.Printf("sesutil.Process error for %s: %s", messageID, err)
+		h.sendFailed(ctx, getObjectInput, messageID, d.alias, "sesutil.Process", err)
+		return err
 	}
-	for _, line := range strings.Split(string(body), "\n") {
-		line = extractEmail(line)
-		if line != "" {
-			res[line] = struct{}{}
+	if h.offloadLimit > 0 && len(rawMessage.Data) > h.offloadLimit {
+		data, offloadErr := sesutil.Offload(rawMessage.Data, h.offloadLimit, h.storeAttachment(ctx, messageID))
+		if offloadErr != nil {
+			log.Printf("sesutil.Offload error for %s: %s", messageID, offloadErr)
+		} else {
+			rawMessage.Data = data
 		}
 	}
-	return res
+
+	_, err = h.sesClient.SendRawEmail(ctx, &ses.SendRawEmailInput{
+		RawMessage:   rawMessage,
+		Source:       &h.from,
+		Destinations: d.to,
+	})
+	if err != nil {
+		log.Printf("sesClient.SendRawEmail error for %s to %v: %s", messageID, d.to, err)
+		h.sendFailed(ctx, getObjectInput, messageID, d.alias, "SendRawEmail", err)
+		return err
+	}
+	return nil
 }
 
-func updateBlocks(ctx context.Context, client s3API, bucket *string, current map[string]struct{}, news []string) {
-	for _, n := range news {
-		current[extractEmail(n)] = struct{}{}
+// sendFailed alerts the owner that messageID, received at alias, could not be forwarded. The message
+// is left in the bucket and the alert links to it along with a release command to retry. The owner
+// of the route of alias is alerted too when that is someone else.
+func (h *handler) sendFailed(ctx context.Context, getObjectInput *s3.GetObjectInput, messageID, alias, op string, err error) {
+	psReq, psErr := h.presigner.PresignGetObject(ctx, getObjectInput)
+	if psErr != nil {
+		h.ec.Send(fmt.Sprintf("PresignGetObject err : %s", psErr))
+		return
 	}
-	var sb strings.Builder
-	for k := range current {
-		sb.WriteString(k)
-		sb.WriteString("\n")
+	h.ec.Send(fmt.Sprintf("RawEmail %s \r\n%s err : %s\r\nRetry with %s",
+		psReq.URL, op, err, h.releaseLink(strings.TrimPrefix(messageID, quarantinePrefix))))
+	if owner := h.routeFor(alias).Owner; owner != h.to {
+		h.scoped(owner).ec.Send(fmt.Sprintf("RawEmail %s \r\n%s err : %s\r\n%s can retry it",
+			psReq.URL, op, err, h.to))
 	}
-	_, err := client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: bucket,
-		Key:    aws.String(blocksKey),
-		Body:   strings.NewReader(sb.String()),
+}
+
+// keepFailed records aliases, those whose deliveries of the message at key failed, as the recipients
+// in its metadata for release to retry. Other metadata, such as that of the quarantine, is kept.
+func (h *handler) keepFailed(ctx context.Context, key string, aliases []string) {
+	var to []string
+	for _, alias := range aliases {
+		if alias != "" {
+			to = append(to, alias)
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+	metadata := make(map[string]string)
+	if head, err := h.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: h.bucket, Key: aws.String(key)}); err == nil {
+		for name, value := range head.Metadata {
+			metadata[name] = value
+		}
+	}
+	delete(metadata, "to")
+	size := len("to")
+	for name, value := range metadata {
+		size += len(name) + len(value)
+	}
+	metadata["to"], _ = metadataAddresses(to, metadataLimit-size)
+	_, err := h.s3Client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            h.bucket,
+		Key:               aws.String(key),
+		CopySource:        aws.String(aws.ToString(h.bucket) + "/" + key),
+		Metadata:          metadata,
+		MetadataDirective: s3Types.MetadataDirectiveReplace,
 	})
 	if err != nil {
-		log.Printf("Error updating blocks.txt: %s", err)
+		log.Printf("s3Client.CopyObject error recording failed recipients of %s: %s", key, err)
+		h.ec.Send(fmt.Sprintf("recording failed recipients of %s err : %s", key, err))
 	}
 }
+
+func deleteObject(ctx context.Context, client s3API, bucket *string, key string) error {
+	_, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+		Bucket: bucket,
+		Delete: &s3Types.Delete{
+			Objects: []s3Types.ObjectIdentifier{{Key: aws.String(key)}},
+		},
+	})
+	return err
+}
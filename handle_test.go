@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+type mockNotifier struct {
+	messages []string
+}
+
+func (m *mockNotifier) Send(message string) {
+	m.messages = append(m.messages, message)
+}
+
+func TestHandle_NoRecords(t *testing.T) {
+	response, err := Handle(context.Background(), events.SimpleEmailEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Disposition != events.SimpleEmailContinue {
+		t.Errorf("disposition = %s; want %s", response.Disposition, events.SimpleEmailContinue)
+	}
+}
+
+func TestInvoke_SimpleEmailEvent(t *testing.T) {
+	response, err := Invoke(context.Background(), []byte(`{"Records":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disposition, ok := response.(events.SimpleEmailDisposition); !ok || disposition.Disposition != events.SimpleEmailContinue {
+		t.Errorf("unexpected response %#v", response)
+	}
+}
+
+func TestHandleRecord_Blocked(t *testing.T) {
+	mock := &mockS3{}
+	h := &handler{
+		s3Client: mock,
+		to:       "owner@gmail.com",
+		ec:       &mockNotifier{},
+		blocks:   blockList{"shady@mlctrez.com": {}},
+	}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Destination = []string{"Shady <shady@mlctrez.com>"}
+
+	if disposition := h.handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("disposition = %s; want %s", disposition, events.SimpleEmailStopRuleSet)
+	}
+	if len(mock.deleted) != 1 || mock.deleted[0] != "message-id" {
+		t.Errorf("deleted = %v; want [message-id]", mock.deleted)
+	}
+}
+
+func TestHandleRecord_BlockedSender(t *testing.T) {
+	mock := &mockS3{}
+	h := &handler{
+		s3Client: mock,
+		to:       "owner@gmail.com",
+		ec:       &mockNotifier{},
+		blocks:   blockList{},
+		senders:  blockList{"@spammer.example.com": {}},
+	}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "bounce@mailer.example.net"
+	record.SES.Mail.CommonHeaders.From = []string{"Spammer <deals@spammer.example.com>"}
+	record.SES.Mail.Destination = []string{"shop@mlctrez.com"}
+
+	if disposition := h.handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("disposition = %s; want %s", disposition, events.SimpleEmailStopRuleSet)
+	}
+	if len(mock.deleted) != 1 || mock.deleted[0] != "message-id" {
+		t.Errorf("deleted = %v; want [message-id]", mock.deleted)
+	}
+}
+
+func TestForward_ProcessError(t *testing.T) {
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := io.MultiReader(strings.NewReader("From: sender@example.com\r\n\r\npartial"), iotest.ErrReader(errors.New("connection reset")))
+			return &s3.GetObjectOutput{Body: io.NopCloser(body)}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	ec := &mockNotifier{}
+	h := &handler{
+		s3Client:  mock,
+		presigner: &mockPresigner{},
+		sesClient: sesMock,
+		bucket:    aws.String("bucket"),
+		from:      "forwarder@mlctrez.com",
+		to:        "owner@gmail.com",
+		ec:        ec,
+	}
+
+	if err := h.forward(context.Background(), "message-id", nil, nil); err == nil {
+		t.Fatal("expected an error for a message that could not be read")
+	}
+	if len(sesMock.sent) != 0 {
+		t.Error("expected no partial message to be sent")
+	}
+	if len(mock.deleted) != 0 {
+		t.Errorf("expected the message to be kept, deleted %v", mock.deleted)
+	}
+	if len(ec.messages) != 1 || !strings.Contains(ec.messages[0], "connection reset") {
+		t.Errorf("unexpected alerts %v", ec.messages)
+	}
+}
+
+func TestForward_PreserveBody(t *testing.T) {
+	message := "From: sender@example.com\nTo: shop@mlctrez.com\n\nsigned body\nwith LF endings"
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(message))}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	h := &handler{
+		s3Client:     mock,
+		sesClient:    sesMock,
+		bucket:       aws.String("bucket"),
+		from:         "forwarder@mlctrez.com",
+		to:           "owner@gmail.com",
+		ec:           &mockNotifier{},
+		preserveBody: true,
+	}
+
+	if err := h.forward(context.Background(), "message-id", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(sesMock.sent) != 1 || !strings.HasSuffix(string(sesMock.sent[0].RawMessage.Data), "\r\n\r\nsigned body\nwith LF endings") {
+		t.Errorf("expected the body to be forwarded unchanged, got %v", sesMock.sent)
+	}
+}
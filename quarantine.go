@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const quarantinePrefix = "quarantine/"
+
+// digestLimit bounds the number of messages listed in one digest email.
+const digestLimit = 100
+
+// loadBlockAction reads BLOCK_ACTION, either drop (the default) or quarantine.
+func loadBlockAction() verdictAction {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("BLOCK_ACTION")))
+	if value == "" {
+		return actionDrop
+	}
+	if action, ok := verdictActionNames[value]; ok && (action == actionDrop || action == actionQuarantine) {
+		return action
+	}
+	log.Printf("ignoring unsupported BLOCK_ACTION %q", value)
+	return actionDrop
+}
+
+// metadataLimit is the most user-defined metadata S3 stores with an object, counting keys and values.
+const metadataLimit = 2048
+
+// metadataFieldLimit caps the reason, from and subject metadata, leaving the rest for to.
+const metadataFieldLimit = 400
+
+// quarantineMetadata describes sesMail for the digest. Values are RFC 2047 encoded since S3 metadata is
+// ASCII only, and shortened to fit metadataLimit. Recipients that don't fit are left out whole.
+func quarantineMetadata(sesMail events.SimpleEmailMessage, reason string) map[string]string {
+	metadata := map[string]string{
+		"reason":  truncateMetadata(reason, metadataFieldLimit),
+		"from":    truncateMetadata(strings.Join(sesMail.CommonHeaders.From, ", "), metadataFieldLimit),
+		"subject": truncateMetadata(sesMail.CommonHeaders.Subject, metadataFieldLimit),
+	}
+	size := len("to")
+	for name, value := range metadata {
+		size += len(name) + len(value)
+	}
+	to, left := metadataAddresses(sesMail.Destination, metadataLimit-size)
+	if left > 0 {
+		log.Printf("leaving %d recipients of %s out of the metadata", left, sesMail.MessageID)
+	}
+	metadata["to"] = to
+	return metadata
+}
+
+// metadataAddresses encodes as many of addresses as fit in limit bytes, returning how many were left out.
+func metadataAddresses(addresses []string, limit int) (string, int) {
+	var fit []string
+	for _, address := range addresses {
+		if len(encodeMetadata(strings.Join(append(fit, address), ", "))) > limit {
+			break
+		}
+		fit = append(fit, address)
+	}
+	return encodeMetadata(strings.Join(fit, ", ")), len(addresses) - len(fit)
+}
+
+func encodeMetadata(value string) string {
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// truncateMetadata encodes value, cut short and ending in "..." when the encoding exceeds limit bytes.
+func truncateMetadata(value string, limit int) string {
+	encoded := encodeMetadata(value)
+	for runes := []rune(value); len(encoded) > limit && len(runes) > 0; {
+		runes = runes[:len(runes)*limit/len(encoded)]
+		encoded = encodeMetadata(string(runes) + "...")
+	}
+	return encoded
+}
+
+// quarantineObject moves key under quarantinePrefix with metadata describing why.
+func quarantineObject(ctx context.Context, client s3API, bucket *string, key string, metadata map[string]string) error {
+	_, err := client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket:            bucket,
+		Key:               aws.String(quarantinePrefix + key),
+		CopySource:        aws.String(*bucket + "/" + key),
+		Metadata:          metadata,
+		MetadataDirective: s3Types.MetadataDirectiveReplace,
+	})
+	if err != nil {
+		return err
+	}
+	return deleteObject(ctx, client, bucket, key)
+}
+
+func (h *handler) quarantine(ctx context.Context, sesMail events.SimpleEmailMessage, reason string) {
+	if err := quarantineObject(ctx, h.s3Client, h.bucket, sesMail.MessageID, quarantineMetadata(sesMail, reason)); err != nil {
+		log.Printf("quarantine error for %s: %s", sesMail.MessageID, err)
+		h.ec.Send(fmt.Sprintf("quarantine err for %s : %s", sesMail.MessageID, err))
+	}
+}
+
+// Digest emails the owner a list of quarantined messages. It is invoked by a scheduled
+// EventBridge rule and sends nothing when the quarantine is empty.
+func Digest(ctx context.Context) error {
+	h := newHandler(ctx)
+	digest, count, err := h.digest(ctx)
+	if err != nil || count == 0 {
+		return err
+	}
+	h.ec.Send(digest)
+	return nil
+}
+
+// digest lists up to digestLimit quarantined messages with download links and release commands.
+func (h *handler) digest(ctx context.Context) (digest string, count int, err error) {
+	var sb strings.Builder
+	paginator := s3.NewListObjectsV2Paginator(h.s3Client, &s3.ListObjectsV2Input{
+		Bucket: h.bucket,
+		Prefix: aws.String(quarantinePrefix),
+	})
+	for paginator.HasMorePages() && count < digestLimit {
+		var page *s3.ListObjectsV2Output
+		if page, err = paginator.NextPage(ctx); err != nil {
+			return "", count, err
+		}
+		for _, object := range page.Contents {
+			if count == digestLimit {
+				break
+			}
+			count++
+			h.digestEntry(ctx, &sb, object)
+		}
+	}
+	if count == 0 {
+		return "No quarantined messages.", 0, nil
+	}
+	header := fmt.Sprintf("%d quarantined messages", count)
+	if count == digestLimit {
+		header = fmt.Sprintf("First %d quarantined messages", count)
+	}
+	return header + "\r\n\r\n" + sb.String(), count, nil
+}
+
+func (h *handler) digestEntry(ctx context.Context, sb *strings.Builder, object s3Types.Object) {
+	key := aws.ToString(object.Key)
+	id := strings.TrimPrefix(key, quarantinePrefix)
+	decoder := new(mime.WordDecoder)
+	line := func(name, value string) {
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		sb.WriteString(fmt.Sprintf("  %s: %s\r\n", name, value))
+	}
+
+	sb.WriteString(id + "\r\n")
+	if object.LastModified != nil {
+		line("quarantined", object.LastModified.UTC().Format("2006-01-02 15:04 MST"))
+	}
+	if head, err := h.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: h.bucket, Key: object.Key}); err == nil {
+		for _, name := range []string{"reason", "from", "to", "subject"} {
+			if value := head.Metadata[name]; value != "" {
+				line(name, value)
+			}
+		}
+	}
+	if psReq, err := h.presigner.PresignGetObject(ctx, &s3.GetObjectInput{Bucket: h.bucket, Key: object.Key}); err == nil {
+		line("download", psReq.URL)
+	}
+	line("release", h.releaseLink(id))
+	sb.WriteString("\r\n")
+}
+
+// releaseKey returns the key of message id, looking in the quarantine before the bucket root
+// where messages that failed to send are left, and the aliases it is still to be delivered for as
+// recorded in its metadata, at quarantine or after a failed delivery.
+func (h *handler) releaseKey(ctx context.Context, id string) (key string, aliases []string, err error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return "", nil, fmt.Errorf("invalid message id %q", id)
+	}
+	for _, key = range []string{quarantinePrefix + id, id} {
+		head, headErr := h.s3Client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: h.bucket, Key: aws.String(key)})
+		if headErr != nil {
+			continue
+		}
+		if to, decodeErr := new(mime.WordDecoder).DecodeHeader(head.Metadata["to"]); decodeErr == nil {
+			for _, address := range strings.Split(to, ",") {
+				if alias := extractEmail(address); alias != "" {
+					aliases = append(aliases, alias)
+				}
+			}
+		}
+		return key, aliases, nil
+	}
+	return "", nil, fmt.Errorf("no message %s in the bucket", id)
+}
+
+// release forwards message id with the normal forwarding path, and so with the settings of the
+// domain of each alias, deleting it on success.
+func (h *handler) release(ctx context.Context, id string) error {
+	key, aliases, err := h.releaseKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	return h.forward(ctx, key, aliases, nil)
+}
+
+// releaseLink is a mailto link that sends the release command for id.
+func (h *handler) releaseLink(id string) string {
+	return fmt.Sprintf("mailto:%s?subject=%s", h.from, url.PathEscape("release "+id))
+}
+
+// ReleaseResponse reports the outcome of Release for each message id.
+type ReleaseResponse struct {
+	Released []string          `json:"released"`
+	Failed   map[string]string `json:"failed,omitempty"`
+}
+
+// Release forwards quarantined messages, or messages left in the bucket after a failed send,
+// to the owner. It is invoked with a payload of {"release": ["message-id", ...]}.
+func Release(ctx context.Context, ids ...string) ReleaseResponse {
+	return newHandler(ctx).releaseAll(ctx, ids)
+}
+
+func (h *handler) releaseAll(ctx context.Context, ids []string) (response ReleaseResponse) {
+	response.Released = make([]string, 0, len(ids))
+	for _, id := range ids {
+		if err := h.release(ctx, id); err != nil {
+			log.Printf("release error for %s: %s", id, err)
+			if response.Failed == nil {
+				response.Failed = make(map[string]string)
+			}
+			response.Failed[id] = err.Error()
+			continue
+		}
+		response.Released = append(response.Released, id)
+	}
+	return response
+}
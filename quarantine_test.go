@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+type mockPresigner struct{}
+
+func (m *mockPresigner) PresignGetObject(_ context.Context, params *s3.GetObjectInput, _ ...func(*s3.PresignOptions)) (*v4.PresignedHTTPRequest, error) {
+	return &v4.PresignedHTTPRequest{URL: "https://bucket.s3.amazonaws.com/" + aws.ToString(params.Key)}, nil
+}
+
+func TestHandleRecord_QuarantineBlocked(t *testing.T) {
+	mock := &mockS3{}
+	h := &handler{
+		s3Client:    mock,
+		bucket:      aws.String("bucket"),
+		to:          "owner@gmail.com",
+		ec:          &mockNotifier{},
+		blocks:      blockList{"shady@mlctrez.com": {}},
+		blockAction: actionQuarantine,
+	}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Destination = []string{"shady@mlctrez.com"}
+	record.SES.Mail.CommonHeaders.Subject = "Grüße"
+
+	if disposition := h.handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("disposition = %s; want %s", disposition, events.SimpleEmailStopRuleSet)
+	}
+	if len(mock.copied) != 1 || aws.ToString(mock.copied[0].Key) != quarantinePrefix+"message-id" {
+		t.Fatalf("expected message to be copied to the quarantine, got %v", mock.copied)
+	}
+	metadata := mock.copied[0].Metadata
+	if metadata["reason"] != "blocked: to shady@mlctrez.com matching shady@mlctrez.com" {
+		t.Errorf("unexpected reason %q", metadata["reason"])
+	}
+	if metadata["subject"] != "=?utf-8?q?Gr=C3=BC=C3=9Fe?=" {
+		t.Errorf("expected encoded subject, got %q", metadata["subject"])
+	}
+	if len(mock.deleted) != 1 || mock.deleted[0] != "message-id" {
+		t.Errorf("deleted = %v; want [message-id]", mock.deleted)
+	}
+}
+
+func TestQuarantineMetadata_Limit(t *testing.T) {
+	sesMail := events.SimpleEmailMessage{MessageID: "message-id"}
+	sesMail.CommonHeaders.Subject = strings.Repeat("Grüße ", 200)
+	sesMail.CommonHeaders.From = []string{"sender@example.com"}
+	for i := 0; i < 100; i++ {
+		sesMail.Destination = append(sesMail.Destination, fmt.Sprintf("alias-%d@mlctrez.com", i))
+	}
+
+	metadata := quarantineMetadata(sesMail, "blocked")
+	size := 0
+	for name, value := range metadata {
+		size += len(name) + len(value)
+	}
+	if size > metadataLimit {
+		t.Errorf("metadata is %d bytes; want at most %d", size, metadataLimit)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(metadata["subject"])
+	if err != nil || !strings.HasPrefix(subject, "Grüße") || !strings.HasSuffix(subject, "...") {
+		t.Errorf("expected a shortened subject, got %q %v", subject, err)
+	}
+	to := strings.Split(metadata["to"], ", ")
+	if len(to) == 0 || len(to) == len(sesMail.Destination) || to[len(to)-1] != sesMail.Destination[len(to)-1] {
+		t.Errorf("expected whole recipients to be left out, got %q", metadata["to"])
+	}
+}
+
+func TestDigest(t *testing.T) {
+	mock := &mockS3{
+		listObjectsFunc: func(ctx context.Context, params *s3.ListObjectsV2Input, optFns ...func(*s3.Options)) (*s3.ListObjectsV2Output, error) {
+			return &s3.ListObjectsV2Output{Contents: []s3Types.Object{{Key: aws.String(quarantinePrefix + "message-id")}}}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			return &s3.HeadObjectOutput{Metadata: map[string]string{
+				"reason":  "verdict: spam",
+				"subject": "=?utf-8?q?Gr=C3=BC=C3=9Fe?=",
+			}}, nil
+		},
+	}
+	h := &handler{
+		s3Client:  mock,
+		presigner: &mockPresigner{},
+		bucket:    aws.String("bucket"),
+		from:      "forwarder@mlctrez.com",
+	}
+
+	digest, count, err := h.digest(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("count = %d; want 1", count)
+	}
+	for _, expected := range []string{
+		"message-id\r\n",
+		"reason: verdict: spam",
+		"subject: Grüße",
+		"download: https://bucket.s3.amazonaws.com/quarantine/message-id",
+		"release: mailto:forwarder@mlctrez.com?subject=release%20message-id",
+	} {
+		if !strings.Contains(digest, expected) {
+			t.Errorf("expected %q in digest. Got:\n%s", expected, digest)
+		}
+	}
+}
+
+func TestReleaseAll(t *testing.T) {
+	objects := map[string]string{"failed-id": "From: sender@example.com\nSubject: Hi\n\nBody\n"}
+	mock := &mockS3{
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if _, ok := objects[aws.ToString(params.Key)]; !ok {
+				return nil, &s3Types.NotFound{}
+			}
+			return &s3.HeadObjectOutput{}, nil
+		},
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(objects[aws.ToString(params.Key)]))}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	h := &handler{
+		s3Client:  mock,
+		sesClient: sesMock,
+		bucket:    aws.String("bucket"),
+		from:      "forwarder@mlctrez.com",
+		to:        "owner@gmail.com",
+		ec:        &mockNotifier{},
+	}
+
+	response := h.releaseAll(context.Background(), []string{"failed-id", "missing-id", "../blocks.txt"})
+
+	if len(response.Released) != 1 || response.Released[0] != "failed-id" {
+		t.Errorf("released = %v; want [failed-id]", response.Released)
+	}
+	if len(response.Failed) != 2 {
+		t.Errorf("failed = %v; want two failures", response.Failed)
+	}
+	if len(sesMock.sent) != 1 || sesMock.sent[0].Destinations[0] != "owner@gmail.com" {
+		t.Errorf("expected the failed message to be forwarded to the owner, got %v", sesMock.sent)
+	}
+	if len(mock.deleted) != 1 || mock.deleted[0] != "failed-id" {
+		t.Errorf("deleted = %v; want [failed-id]", mock.deleted)
+	}
+}
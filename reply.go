@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+	"github.com/mlctrez/goemail/sesutil"
+)
+
+const repliesPrefix = "replies/"
+
+const replyLocalPrefix = "reply-"
+
+// replyMapping records who a reply address belongs to. It is stored as JSON under repliesPrefix.
+type replyMapping struct {
+	// Alias is the address on our domain the original email was sent to.
+	Alias string `json:"alias"`
+	// Sender is the address replies are delivered to.
+	Sender string `json:"sender"`
+}
+
+// replyID derives a stable id for the alias and sender pair so repeated emails reuse one reply address.
+func replyID(alias, sender string) string {
+	sum := sha256.Sum256([]byte(alias + "\n" + sender))
+	return hex.EncodeToString(sum[:10])
+}
+
+func replyAddress(domain, id string) string {
+	return fmt.Sprintf("%s%s@%s", replyLocalPrefix, id, domain)
+}
+
+// parseReplyAddress returns the id of a reply address on domain.
+func parseReplyAddress(address, domain string) (id string, ok bool) {
+	local, addrDomain, found := strings.Cut(extractEmail(address), "@")
+	if !found || addrDomain != strings.ToLower(domain) || !strings.HasPrefix(local, replyLocalPrefix) {
+		return "", false
+	}
+	id = strings.TrimPrefix(local, replyLocalPrefix)
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// originalSender returns the address a reply to sesMail should go to, preferring Reply-To over From.
+func originalSender(sesMail events.SimpleEmailMessage) string {
+	for _, header := range sesMail.Headers {
+		if strings.EqualFold(header.Name, "reply-to") && header.Value != "" {
+			return extractEmail(header.Value)
+		}
+	}
+	if len(sesMail.CommonHeaders.From) > 0 {
+		return extractEmail(sesMail.CommonHeaders.From[0])
+	}
+	return extractEmail(sesMail.Source)
+}
+
+func putReplyMapping(ctx context.Context, client s3API, bucket *string, id string, mapping replyMapping) error {
+	body, err := json.Marshal(mapping)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      bucket,
+		Key:         aws.String(repliesPrefix + id),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func getReplyMapping(ctx context.Context, client s3API, bucket *string, id string) (mapping replyMapping, err error) {
+	var output *s3.GetObjectOutput
+	output, err = client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String(repliesPrefix + id)})
+	if err != nil {
+		return mapping, err
+	}
+	defer func() { _ = output.Body.Close() }()
+	err = json.NewDecoder(output.Body).Decode(&mapping)
+	return mapping, err
+}
+
+// replyHeader records the mapping for sesMail and returns the Reply-To header pointing at it.
+func (h *handler) replyHeader(ctx context.Context, sesMail events.SimpleEmailMessage) (string, error) {
+	if len(sesMail.Destination) == 0 {
+		return "", fmt.Errorf("no destination for %s", sesMail.MessageID)
+	}
+	mapping := replyMapping{Alias: extractEmail(sesMail.Destination[0]), Sender: originalSender(sesMail)}
+	id := replyID(mapping.Alias, mapping.Sender)
+	if err := putReplyMapping(ctx, h.s3Client, h.bucket, id, mapping); err != nil {
+		return "", err
+	}
+	return "Reply-To: " + replyAddress(h.replyDomain, id), nil
+}
+
+// replyTarget returns the id of the first destination of sesMail that is a reply address.
+func (h *handler) replyTarget(sesMail events.SimpleEmailMessage) (string, bool) {
+	if h.replyDomain == "" {
+		return "", false
+	}
+	for _, dest := range sesMail.Destination {
+		if id, ok := parseReplyAddress(dest, h.replyDomain); ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// reply sends the owner's reply stored for sesMail to the original sender, from the alias they wrote to.
+func (h *handler) reply(ctx context.Context, sesMail events.SimpleEmailMessage, id string) {
+	mapping, err := getReplyMapping(ctx, h.s3Client, h.bucket, id)
+	if err != nil {
+		log.Printf("getReplyMapping error for %s: %s", id, err)
+		h.ec.Send(fmt.Sprintf("no reply address %s : %s", id, err))
+		_ = deleteObject(ctx, h.s3Client, h.bucket, sesMail.MessageID)
+		return
+	}
+	if !h.owns(mapping.Alias) {
+		log.Printf("rejecting reply %s from %s through %s", sesMail.MessageID, h.scope, mapping.Alias)
+		_ = deleteObject(ctx, h.s3Client, h.bucket, sesMail.MessageID)
+		return
+	}
+
+	output, err := h.s3Client.GetObject(ctx, &s3.GetObjectInput{Bucket: h.bucket, Key: aws.String(sesMail.MessageID)})
+	if err != nil {
+		log.Printf("s3Client.GetObject error for %s: %s", sesMail.MessageID, err)
+		h.ec.Send(fmt.Sprintf("s3Client.GetObject err : %s", err))
+		return
+	}
+
+	rawMessage, err := sesutil.ProcessReply(output.Body, mapping.Alias, mapping.Sender)
+	if err != nil {
+		log.Printf("sesutil.ProcessReply error for %s: %s", sesMail.MessageID, err)
+		h.ec.Send(fmt.Sprintf("reply to %s from %s failed : %s", mapping.Sender, mapping.Alias, err))
+		return
+	}
+
+	_, err = h.sesClient.SendRawEmail(ctx, &ses.SendRawEmailInput{
+		RawMessage:   rawMessage,
+		Source:       aws.String(mapping.Alias),
+		Destinations: []string{mapping.Sender},
+	})
+	if err != nil {
+		log.Printf("sesClient.SendRawEmail error for reply %s: %s", sesMail.MessageID, err)
+		h.ec.Send(fmt.Sprintf("reply to %s from %s failed : %s", mapping.Sender, mapping.Alias, err))
+		return
+	}
+	h.learnAlias(ctx, mapping.Alias)
+
+	if errDel := deleteObject(ctx, h.s3Client, h.bucket, sesMail.MessageID); errDel != nil {
+		log.Printf("s3Client.DeleteObjects error for %s: %s", sesMail.MessageID, errDel)
+	}
+}
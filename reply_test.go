@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ses"
+)
+
+type mockSES struct {
+	sent []*ses.SendRawEmailInput
+	// failTo makes sends to this destination fail
+	failTo string
+}
+
+func (m *mockSES) SendRawEmail(_ context.Context, params *ses.SendRawEmailInput, _ ...func(*ses.Options)) (*ses.SendRawEmailOutput, error) {
+	for _, dest := range params.Destinations {
+		if m.failTo != "" && dest == m.failTo {
+			return nil, errors.New("throttled")
+		}
+	}
+	m.sent = append(m.sent, params)
+	return &ses.SendRawEmailOutput{}, nil
+}
+
+func TestParseReplyAddress(t *testing.T) {
+	id := replyID("shop@mlctrez.com", "store@example.com")
+	address := replyAddress("mlctrez.com", id)
+
+	if got, ok := parseReplyAddress("Shop <"+strings.ToUpper(address)+">", "mlctrez.com"); !ok || got != id {
+		t.Errorf("parseReplyAddress(%q) = %q, %v; want %q", address, got, ok, id)
+	}
+	if _, ok := parseReplyAddress(address, "example.com"); ok {
+		t.Error("expected reply address on another domain to be rejected")
+	}
+	if _, ok := parseReplyAddress("reply-nothex@mlctrez.com", "mlctrez.com"); ok {
+		t.Error("expected non hex id to be rejected")
+	}
+}
+
+func TestHandleRecord_Reply(t *testing.T) {
+	objects := map[string]string{
+		"message-id": "From: Me <owner@gmail.com>\nTo: reply-00@mlctrez.com\nX-Gm-Message-State: abc\nSubject: Re: order\n\nthanks\n",
+	}
+	id := replyID("shop@mlctrez.com", "store@example.com")
+	objects[repliesPrefix+id] = `{"alias":"shop@mlctrez.com","sender":"store@example.com"}`
+
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(objects[aws.ToString(params.Key)]))}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	h := &handler{
+		s3Client:    mock,
+		sesClient:   sesMock,
+		to:          "owner@gmail.com",
+		bucket:      aws.String("bucket"),
+		ec:          &mockNotifier{},
+		replyDomain: "mlctrez.com",
+	}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "owner@gmail.com"
+	record.SES.Mail.Destination = []string{replyAddress("mlctrez.com", id)}
+
+	if disposition := h.handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("disposition = %s; want %s", disposition, events.SimpleEmailStopRuleSet)
+	}
+	if len(sesMock.sent) != 1 {
+		t.Fatalf("expected one reply to be sent, got %d", len(sesMock.sent))
+	}
+	sent := sesMock.sent[0]
+	if aws.ToString(sent.Source) != "shop@mlctrez.com" || sent.Destinations[0] != "store@example.com" {
+		t.Errorf("reply sent from %s to %v", aws.ToString(sent.Source), sent.Destinations)
+	}
+	output := string(sent.RawMessage.Data)
+	if strings.Contains(output, "owner@gmail.com") || strings.Contains(output, "X-Gm-Message-State") {
+		t.Errorf("reply reveals the owner mailbox. Got:\n%s", output)
+	}
+	if len(mock.deleted) != 1 || mock.deleted[0] != "message-id" {
+		t.Errorf("deleted = %v; want [message-id]", mock.deleted)
+	}
+}
+
+func TestHandleRecord_CommandWithoutReplyMapping(t *testing.T) {
+	var putBody string
+	h, ec := commandHandler(&putBody)
+	h.replyDomain = "mlctrez.com"
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "owner@gmail.com"
+	record.SES.Mail.Destination = []string{"news@mlctrez.com"}
+	record.SES.Mail.CommonHeaders.Subject = "blocks"
+
+	if disposition := h.handleRecord(context.Background(), record); disposition != events.SimpleEmailStopRuleSet {
+		t.Errorf("disposition = %s; want %s", disposition, events.SimpleEmailStopRuleSet)
+	}
+	if len(ec.messages) != 1 {
+		t.Errorf("expected the blocks command to be answered, got %v", ec.messages)
+	}
+	if putBody != "" {
+		t.Errorf("expected no reply mapping for a command, put %q", putBody)
+	}
+}
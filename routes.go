@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// route delivers mail received at the aliases matching Match to the mailboxes in To.
+type route struct {
+	// Match is an address, glob pattern or domain in the format of blocks.txt, or * for the aliases
+	// no other route matches.
+	Match string   `json:"match"`
+	To    []string `json:"to"`
+	// Owner may send commands for the aliases of the route, the first of To when empty.
+	Owner string `json:"owner,omitempty"`
+}
+
+// routeTable maps aliases to the mailboxes they are delivered to.
+type routeTable []route
+
+// parseRoutes reads a JSON list of routes, such as
+//
+//	[{"match": "@ops.example.com", "to": ["alice@example.net", "bob@example.net"]}, {"match": "*", "to": ["me@gmail.com"]}]
+func parseRoutes(data []byte) (routeTable, error) {
+	var routes routeTable
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, err
+	}
+	if err := routes.normalize(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// normalize checks the routes and brings their addresses to the form match compares.
+func (t routeTable) normalize() error {
+	for i := range t {
+		r := &t[i]
+		if r.Match = normalizeBlock(r.Match); r.Match == "" {
+			return fmt.Errorf("route %d has no match", i)
+		}
+		seen := make(map[string]bool)
+		to := make([]string, 0, len(r.To))
+		for _, address := range r.To {
+			if address = extractEmail(address); address != "" && !seen[address] {
+				seen[address] = true
+				to = append(to, address)
+			}
+		}
+		if len(to) == 0 {
+			return fmt.Errorf("route for %s has no to", r.Match)
+		}
+		r.To = to
+		if r.Owner = extractEmail(r.Owner); r.Owner == "" {
+			r.Owner = to[0]
+		}
+	}
+	return nil
+}
+
+// hasCatchAll reports whether t has a route for the aliases no other route matches.
+func (t routeTable) hasCatchAll() bool {
+	for _, r := range t {
+		if r.Match == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutCatchAll returns the routes of t other than the catch-all.
+func (t routeTable) withoutCatchAll() routeTable {
+	routes := make(routeTable, 0, len(t))
+	for _, r := range t {
+		if r.Match != "*" {
+			routes = append(routes, r)
+		}
+	}
+	return routes
+}
+
+// match returns the route for the exact alias, or else the first route with a pattern or domain
+// matching it, or else the catch-all route.
+func (t routeTable) match(alias string) (route, bool) {
+	alias = extractEmail(alias)
+	_, domain, _ := strings.Cut(alias, "@")
+	for _, r := range t {
+		if r.Match == alias {
+			return r, true
+		}
+	}
+	for _, r := range t {
+		if r.Match != "*" && blockMatches(r.Match, alias, domain) {
+			return r, true
+		}
+	}
+	for _, r := range t {
+		if r.Match == "*" {
+			return r, true
+		}
+	}
+	return route{}, false
+}
+
+// loadRoutes reads ROUTES, either a JSON list of routes or the key of a JSON object in the bucket
+// holding them. Without routes every alias is delivered to EMAIL_TO.
+func loadRoutes(ctx context.Context, client s3API, bucket *string, ec notifier) routeTable {
+	value := strings.TrimSpace(os.Getenv("ROUTES"))
+	parse := func(data []byte, source string) interface{} {
+		routes, err := parseRoutes(data)
+		if err != nil {
+			log.Printf("ignoring invalid routes in %s: %s", source, err)
+			ec.Send(fmt.Sprintf("ignoring invalid routes in %s : %s", source, err))
+			return routeTable(nil)
+		}
+		return routes
+	}
+	switch {
+	case value == "":
+		return nil
+	case strings.HasPrefix(value, "["):
+		return parse([]byte(value), "ROUTES").(routeTable)
+	}
+	routes, _ := cachedObject(ctx, client, bucket, value, parse, routeTable(nil))
+	return routes.(routeTable)
+}
+
+// routeFor returns the route for alias, EMAIL_TO owning every alias when no route matches.
+func (h *handler) routeFor(alias string) route {
+	if r, ok := h.routes.match(alias); ok {
+		return r
+	}
+	return route{Match: "*", To: []string{h.to}, Owner: h.to}
+}
+
+// destinations are the mailboxes mail received at alias is forwarded to, with the alias as their
+// subaddress when plusAddress is set.
+func (h *handler) destinations(alias string) []string {
+	to := h.routeFor(alias).To
+	if !h.plusAddress {
+		return to
+	}
+	subaddressed := make([]string, 0, len(to))
+	for _, address := range to {
+		subaddressed = append(subaddressed, withSubaddress(address, alias))
+	}
+	return subaddressed
+}
+
+// delivery is one SendRawEmail of a forwarded message.
+type delivery struct {
+	// handler has the settings of the domain of the aliases
+	handler *handler
+	// alias is the first of aliases, the aliases of the message routed to the mailboxes in to
+	alias   string
+	aliases []string
+	to      []string
+}
+
+// deliveries groups aliases by the settings of their domain and the mailboxes they are forwarded to,
+// so that each unique set of mailboxes gets the message once from each forwarding identity. Without
+// aliases the message goes to the catch-all route of h.
+func (h *handler) deliveries(ctx context.Context, aliases []string) []delivery {
+	if len(aliases) == 0 {
+		aliases = []string{""}
+	}
+	var result []delivery
+	seen := make(map[string]int)
+	for _, alias := range aliases {
+		alias = extractEmail(alias)
+		d := h
+		if alias != "" {
+			d = h.forDomain(ctx, alias)
+		}
+		to := d.destinations(alias)
+		sorted := append([]string(nil), to...)
+		sort.Strings(sorted)
+		key := d.from + " " + strings.Join(sorted, ",")
+		if i, ok := seen[key]; ok {
+			result[i].aliases = append(result[i].aliases, alias)
+			continue
+		}
+		seen[key] = len(result)
+		result = append(result, delivery{handler: d, alias: alias, aliases: []string{alias}, to: to})
+	}
+	return result
+}
+
+// ownerOf returns the owner address, or one of its subaddresses, is from. The owners are EMAIL_TO
+// and the owners of each route.
+func (h *handler) ownerOf(address string) string {
+	base := baseAddress(address)
+	if base == h.to {
+		return h.to
+	}
+	for _, r := range h.routes {
+		if r.Owner == base {
+			return base
+		}
+	}
+	return ""
+}
+
+// scopedCommands are the commands route owners other than EMAIL_TO may use.
+var scopedCommands = map[string]bool{"block": true, "unblock": true, "create": true, "disable": true, "help": true}
+
+// scoped returns h for commands and replies from owner. Route owners other than EMAIL_TO receive
+// the confirmations themselves and may only act on the aliases routed to them.
+func (h *handler) scoped(owner string) *handler {
+	if owner == h.to {
+		return h
+	}
+	scoped := *h
+	scoped.scope = owner
+	if h.notifierFor != nil {
+		scoped.ec = h.notifierFor(h.from, owner)
+	}
+	return &scoped
+}
+
+// owns reports whether h may act on alias, always true unless h is scoped to a route owner.
+func (h *handler) owns(alias string) bool {
+	return h.scope == "" || h.routeFor(alias).Owner == h.scope
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const testRoutes = `[
+	{"match": "@ops.mlctrez.com", "to": ["Alice <alice@example.net>", "bob@example.net"]},
+	{"match": "pager@ops.mlctrez.com", "to": ["oncall@example.net"]},
+	{"match": "kids-*@mlctrez.com", "to": ["parent@example.net"], "owner": "parent@example.net"},
+	{"match": "*", "to": ["owner@gmail.com"]}
+]`
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := parseRoutes([]byte(testRoutes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if routes[0].To[0] != "alice@example.net" || routes[0].Owner != "alice@example.net" {
+		t.Errorf("expected addresses to be normalized and the owner defaulted, got %+v", routes[0])
+	}
+	for _, invalid := range []string{`[{"match": "", "to": ["a@b.c"]}]`, `[{"match": "*", "to": []}]`, `{}`} {
+		if _, err = parseRoutes([]byte(invalid)); err == nil {
+			t.Errorf("expected an error for %s", invalid)
+		}
+	}
+}
+
+func TestRouteTable_Match(t *testing.T) {
+	routes, _ := parseRoutes([]byte(testRoutes))
+	for alias, expected := range map[string]string{
+		"Pager@ops.mlctrez.com":   "oncall@example.net",
+		"deploy@ops.mlctrez.com":  "alice@example.net",
+		"kids-school@mlctrez.com": "parent@example.net",
+		"shop@mlctrez.com":        "owner@gmail.com",
+	} {
+		if r, ok := routes.match(alias); !ok || r.To[0] != expected {
+			t.Errorf("match(%q) = %+v; want %s", alias, r, expected)
+		}
+	}
+	if _, ok := routeTable(nil).match("shop@mlctrez.com"); ok {
+		t.Error("expected no route without a routing table")
+	}
+}
+
+func TestHandleRecord_Routes(t *testing.T) {
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := "From: sender@example.com\r\nTo: deploy@ops.mlctrez.com\r\nSubject: Alert\r\n\r\nbody\r\n"
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	routes, _ := parseRoutes([]byte(testRoutes))
+	h := &handler{
+		s3Client:  mock,
+		sesClient: sesMock,
+		bucket:    aws.String("bucket"),
+		from:      "forwarder@mlctrez.com",
+		to:        "owner@gmail.com",
+		ec:        &mockNotifier{},
+		routes:    routes,
+	}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "sender@example.com"
+	record.SES.Mail.Destination = []string{"deploy@ops.mlctrez.com", "build@ops.mlctrez.com", "shop@mlctrez.com"}
+
+	h.handleRecord(context.Background(), record)
+	if len(sesMock.sent) != 2 {
+		t.Fatalf("expected one message per destination set, got %d", len(sesMock.sent))
+	}
+	if to := sesMock.sent[0].Destinations; len(to) != 2 || to[0] != "alice@example.net" || to[1] != "bob@example.net" {
+		t.Errorf("unexpected destinations %v", to)
+	}
+	if to := sesMock.sent[1].Destinations; len(to) != 1 || to[0] != "owner@gmail.com" {
+		t.Errorf("unexpected destinations %v", to)
+	}
+	if len(mock.deleted) != 1 {
+		t.Errorf("expected the message to be deleted once, deleted %v", mock.deleted)
+	}
+}
+
+func TestForward_PartialFailure(t *testing.T) {
+	metadata := map[string]string{"reason": "blocked"}
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := "From: sender@example.com\r\nTo: deploy@ops.mlctrez.com\r\nSubject: Alert\r\n\r\nbody\r\n"
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+		headObjectFunc: func(ctx context.Context, params *s3.HeadObjectInput, optFns ...func(*s3.Options)) (*s3.HeadObjectOutput, error) {
+			if aws.ToString(params.Key) != "message-id" {
+				return nil, &s3Types.NotFound{}
+			}
+			return &s3.HeadObjectOutput{Metadata: metadata}, nil
+		},
+	}
+	sesMock := &mockSES{failTo: "alice@example.net"}
+	routes, _ := parseRoutes([]byte(testRoutes))
+	ec, aliceEC := &mockNotifier{}, &mockNotifier{}
+	h := &handler{
+		s3Client:    mock,
+		presigner:   &mockPresigner{},
+		sesClient:   sesMock,
+		bucket:      aws.String("bucket"),
+		from:        "forwarder@mlctrez.com",
+		to:          "owner@gmail.com",
+		ec:          ec,
+		routes:      routes,
+		notifierFor: func(from, to string) notifier { return aliceEC },
+	}
+
+	aliases := []string{"deploy@ops.mlctrez.com", "build@ops.mlctrez.com", "shop@mlctrez.com"}
+	if err := h.forward(context.Background(), "message-id", aliases, nil); err == nil {
+		t.Fatal("expected an error for the failed delivery")
+	}
+	if len(sesMock.sent) != 1 || sesMock.sent[0].Destinations[0] != "owner@gmail.com" {
+		t.Errorf("expected the other delivery to be attempted, sent %v", sesMock.sent)
+	}
+	if len(mock.deleted) != 0 || len(mock.copied) != 1 {
+		t.Fatalf("expected the message to be kept with new metadata, deleted %v copied %v", mock.deleted, mock.copied)
+	}
+	if metadata = mock.copied[0].Metadata; metadata["to"] != "deploy@ops.mlctrez.com, build@ops.mlctrez.com" || metadata["reason"] != "blocked" {
+		t.Errorf("expected the failed aliases to be recorded, got %v", metadata)
+	}
+	if len(ec.messages) != 1 || len(aliceEC.messages) != 1 {
+		t.Errorf("expected the owner and the route owner to be alerted, got %v and %v", ec.messages, aliceEC.messages)
+	}
+
+	sesMock.failTo = ""
+	if err := h.release(context.Background(), "message-id"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sesMock.sent) != 2 || sesMock.sent[1].Destinations[0] != "alice@example.net" {
+		t.Errorf("expected release to retry only the failed delivery, sent %v", sesMock.sent)
+	}
+	if len(mock.deleted) != 1 {
+		t.Errorf("expected the message to be deleted after release, deleted %v", mock.deleted)
+	}
+}
+
+func TestCommand_RouteOwner(t *testing.T) {
+	var putBody string
+	h, _ := commandHandler(&putBody)
+	h.routes, _ = parseRoutes([]byte(testRoutes))
+	parentEC := &mockNotifier{}
+	h.notifierFor = func(from, to string) notifier { return parentEC }
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.Source = "parent+kids@example.net"
+	owner := h.commandOwner(record)
+	if owner != "parent@example.net" {
+		t.Fatalf("commandOwner = %q; want parent@example.net", owner)
+	}
+	scoped := h.scoped(owner)
+
+	sesMail := events.SimpleEmailMessage{MessageID: "message-id"}
+	sesMail.CommonHeaders.Subject = "block kids-spam@mlctrez.com news@mlctrez.com"
+	if !scoped.command(context.Background(), sesMail) {
+		t.Fatal("expected block command from the route owner to be handled")
+	}
+	if !strings.Contains(putBody, "kids-spam@mlctrez.com") || strings.Contains(putBody, "news@mlctrez.com") {
+		t.Errorf("expected only the owned alias to be blocked, put %q", putBody)
+	}
+	if len(parentEC.messages) != 1 {
+		t.Errorf("expected the route owner to be notified, got %v", parentEC.messages)
+	}
+
+	sesMail.CommonHeaders.Subject = "blocks"
+	if scoped.command(context.Background(), sesMail) {
+		t.Error("expected blocks command from a route owner to be ignored")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3Types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/mlctrez/goemail/sesutil"
+)
+
+type objectCacheEntry struct {
+	value   interface{}
+	found   bool
+	checked time.Time
+}
+
+var (
+	objectCacheMu sync.Mutex
+	// objectCache keeps configuration read from the bucket across warm invocations, refreshed after blockCacheTTL.
+	objectCache = make(map[string]*objectCacheEntry)
+)
+
+// cachedObject returns the value parse returns for the object at key, reading the object again after
+// blockCacheTTL, and whether the object exists. A missing object gives fallback and is cached too.
+// When it can't be read the previous value is kept, or fallback returned when there is none.
+func cachedObject(ctx context.Context, client s3API, bucket *string, key string,
+	parse func(data []byte, source string) interface{}, fallback interface{}) (interface{}, bool) {
+	objectCacheMu.Lock()
+	defer objectCacheMu.Unlock()
+	cacheKey := aws.ToString(bucket) + "/" + key
+	entry := objectCache[cacheKey]
+	if entry != nil && time.Since(entry.checked) < blockCacheTTL {
+		return entry.value, entry.found
+	}
+	data, err := readObject(ctx, client, bucket, key)
+	var noSuchKey *s3Types.NoSuchKey
+	switch {
+	case errors.As(err, &noSuchKey):
+		objectCache[cacheKey] = &objectCacheEntry{value: fallback, checked: time.Now()}
+		return fallback, false
+	case err != nil:
+		log.Printf("Error reading %s: %s", key, err)
+		if entry != nil {
+			return entry.value, entry.found
+		}
+		return fallback, false
+	}
+	value := parse(data, key)
+	objectCache[cacheKey] = &objectCacheEntry{value: value, found: true, checked: time.Now()}
+	return value, true
+}
+
+func invalidateObject(bucket *string, key string) {
+	objectCacheMu.Lock()
+	defer objectCacheMu.Unlock()
+	delete(objectCache, aws.ToString(bucket)+"/"+key)
+}
+
+func readObject(ctx context.Context, client s3API, bucket *string, key string) ([]byte, error) {
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = output.Body.Close() }()
+	return io.ReadAll(output.Body)
+}
+
+// loadHeaderRules reads HEADER_RULES, either a JSON or YAML list of rules or the key of an object
+// in the bucket holding them in either format. Invalid rules are reported and the defaults used instead.
+func loadHeaderRules(ctx context.Context, client s3API, bucket *string, ec notifier) sesutil.HeaderRules {
+	return headerRules(ctx, client, bucket, strings.TrimSpace(os.Getenv("HEADER_RULES")), "HEADER_RULES", ec)
+}
+
+// headerRules returns the rules given by value, in the format of HEADER_RULES, naming source when
+// they are invalid.
+func headerRules(ctx context.Context, client s3API, bucket *string, value, source string, ec notifier) sesutil.HeaderRules {
+	parse := func(data []byte, source string) interface{} {
+		return parseHeaderRules(data, source, ec)
+	}
+	switch {
+	case value == "":
+		return sesutil.DefaultHeaderRules()
+	case strings.HasPrefix(value, "[") || strings.HasPrefix(value, "- "):
+		return parseHeaderRules([]byte(value), source, ec)
+	}
+	rules, _ := cachedObject(ctx, client, bucket, value, parse, sesutil.DefaultHeaderRules())
+	return rules.(sesutil.HeaderRules)
+}
+
+// loadFromName reads FROM_NAME, the display name template for the From of forwarded emails.
+// The default names the original sender and the alias, none leaves From without a display name.
+func loadFromName() *template.Template {
+	value := strings.TrimSpace(os.Getenv("FROM_NAME"))
+	switch strings.ToLower(value) {
+	case "":
+		return nil
+	case "none":
+		value = ""
+	}
+	tmpl, err := sesutil.ParseFromName(value)
+	if err != nil {
+		log.Printf("ignoring invalid FROM_NAME %q: %s", value, err)
+		return nil
+	}
+	return tmpl
+}
+
+// loadSubjectTag reads SUBJECT_TAG, prefix or suffix to label subjects with the alias, and
+// SUBJECT_LABELS, comma separated alias=label pairs. Subjects are not labelled when SUBJECT_TAG is unset.
+func loadSubjectTag() *sesutil.SubjectTag {
+	tag := &sesutil.SubjectTag{Labels: make(map[string]string)}
+	switch value := strings.ToLower(strings.TrimSpace(os.Getenv("SUBJECT_TAG"))); value {
+	case "":
+		return nil
+	case "prefix":
+	case "suffix":
+		tag.Suffix = true
+	default:
+		log.Printf("ignoring unsupported SUBJECT_TAG %q", value)
+		return nil
+	}
+	for _, pair := range strings.Split(os.Getenv("SUBJECT_LABELS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		alias, label, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(label) == "" {
+			log.Printf("ignoring invalid SUBJECT_LABELS entry %q", pair)
+			continue
+		}
+		tag.Labels[extractEmail(alias)] = strings.TrimSpace(label)
+	}
+	return tag
+}
+
+func parseHeaderRules(data []byte, source string, ec notifier) sesutil.HeaderRules {
+	rules, err := sesutil.ParseHeaderRules(data)
+	if err != nil {
+		log.Printf("ignoring invalid header rules in %s: %s", source, err)
+		ec.Send(fmt.Sprintf("ignoring invalid header rules in %s : %s", source, err))
+		return sesutil.DefaultHeaderRules()
+	}
+	return rules
+}
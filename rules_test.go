@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/mlctrez/goemail/sesutil"
+)
+
+func TestLoadHeaderRules(t *testing.T) {
+	var keys []string
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			keys = append(keys, aws.ToString(params.Key))
+			body := `[{"name": "Subject", "action": "set", "value": "[fwd] {{.Value}}"}]`
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	bucket := aws.String("rules-bucket")
+	ec := &mockNotifier{}
+
+	t.Setenv("HEADER_RULES", "header-rules.json")
+	rules := loadHeaderRules(context.Background(), mock, bucket, ec)
+	loadHeaderRules(context.Background(), mock, bucket, ec)
+	if len(keys) != 1 || keys[0] != "header-rules.json" {
+		t.Errorf("expected the rules to be read once, read %v", keys)
+	}
+	if len(rules) != len(sesutil.DefaultHeaderRules())+1 || rules[0].Name != "Subject" {
+		t.Errorf("expected the configured rule before the defaults, got %v", rules)
+	}
+
+	t.Setenv("HEADER_RULES", `[{"name": "Subject", "action": "bogus"}]`)
+	if rules = loadHeaderRules(context.Background(), mock, bucket, ec); len(rules) != len(sesutil.DefaultHeaderRules()) {
+		t.Errorf("expected the defaults for invalid rules, got %v", rules)
+	}
+	if len(ec.messages) != 1 {
+		t.Errorf("expected invalid rules to be reported, got %v", ec.messages)
+	}
+
+	t.Setenv("HEADER_RULES", "- name: Subject\n  action: drop\n")
+	if rules = loadHeaderRules(context.Background(), mock, bucket, ec); len(keys) != 1 || rules[0].Action != sesutil.HeaderDrop {
+		t.Errorf("expected inline YAML rules, got %v after reading %v", rules, keys)
+	}
+}
+
+func TestLoadSubjectTag(t *testing.T) {
+	t.Setenv("SUBJECT_TAG", "")
+	if tag := loadSubjectTag(); tag != nil {
+		t.Errorf("expected no tag by default, got %+v", tag)
+	}
+
+	t.Setenv("SUBJECT_TAG", "Suffix")
+	t.Setenv("SUBJECT_LABELS", "Shop@mlctrez.com=shop-acme, bogus ,news@mlctrez.com=")
+	tag := loadSubjectTag()
+	if tag == nil || !tag.Suffix {
+		t.Fatalf("expected a suffix tag, got %+v", tag)
+	}
+	if len(tag.Labels) != 1 || tag.Labels["shop@mlctrez.com"] != "shop-acme" {
+		t.Errorf("unexpected labels %v", tag.Labels)
+	}
+}
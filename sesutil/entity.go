@@ -0,0 +1,443 @@
+package sesutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+// Field is a header field. A parsed field keeps its original bytes, including folding and line
+// endings, so it is written back unchanged.
+type Field struct {
+	name  string
+	value string
+	raw   []byte
+}
+
+// NewField returns a field with value folded to fit the line length limits of RFC 5322.
+// The value must already be encoded, see EncodeText.
+func NewField(name, value string) *Field {
+	return &Field{name: name, value: value, raw: []byte(fold(name+": "+value) + "\r\n")}
+}
+
+func parseField(raw []byte) *Field {
+	f := &Field{raw: raw}
+	line := string(raw)
+	name, value, found := strings.Cut(line, ":")
+	if !found || strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+		// not a header field, kept as is so the header block round trips
+		return f
+	}
+	f.name = strings.TrimRight(name, " \t")
+	f.value = strings.TrimSpace(unfold(value))
+	return f
+}
+
+// Name returns the field name as written.
+func (f *Field) Name() string { return f.name }
+
+// Value returns the unfolded field value without RFC 2047 decoding.
+func (f *Field) Value() string { return f.value }
+
+// Decoded returns the unfolded field value with RFC 2047 encoded words decoded.
+func (f *Field) Decoded() string {
+	decoded, err := wordDecoder.DecodeHeader(f.value)
+	if err != nil {
+		return f.value
+	}
+	return decoded
+}
+
+// Raw returns the bytes of the field including folding and the final line ending.
+func (f *Field) Raw() []byte { return f.raw }
+
+func (f *Field) is(name string) bool {
+	return f.name != "" && strings.EqualFold(f.name, name)
+}
+
+var wordDecoder = new(mime.WordDecoder)
+
+// EncodeText encodes unstructured header text, such as a Subject, as RFC 2047 encoded words when it
+// is not plain ASCII.
+func EncodeText(s string) string {
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// unfold removes the line breaks of folded header lines.
+func unfold(s string) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\n' {
+			continue
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// maxLineLength is the line length folding aims for, from RFC 5322 section 2.1.1.
+const maxLineLength = 78
+
+// fold breaks line at whitespace so that lines stay within maxLineLength where possible.
+// Continuation lines start with the whitespace the line was broken at.
+func fold(line string) string {
+	if len(line) <= maxLineLength {
+		return line
+	}
+	var sb strings.Builder
+	for len(line) > maxLineLength {
+		cut := strings.LastIndexAny(line[:maxLineLength+1], " \t")
+		if cut <= 0 {
+			// a word longer than the line, break after it instead
+			cut = strings.IndexAny(line[maxLineLength:], " \t")
+			if cut < 0 {
+				break
+			}
+			cut += maxLineLength
+		}
+		if strings.TrimSpace(line[:cut]) == "" || strings.HasSuffix(strings.TrimRight(line[:cut], " \t"), ":") {
+			// never leave a line holding only whitespace or the field name
+			next := strings.IndexAny(line[cut+1:], " \t")
+			if next < 0 {
+				break
+			}
+			cut += next + 1
+		}
+		sb.WriteString(line[:cut])
+		sb.WriteString("\r\n")
+		line = line[cut:]
+	}
+	sb.WriteString(line)
+	return sb.String()
+}
+
+// Header is the ordered list of fields in a header block.
+type Header struct {
+	fields []*Field
+}
+
+// Fields returns the fields in order.
+func (h *Header) Fields() []*Field { return h.fields }
+
+// Field returns the first field called name.
+func (h *Header) Field(name string) *Field {
+	for _, f := range h.fields {
+		if f.is(name) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Get returns the unfolded value of the first field called name.
+func (h *Header) Get(name string) string {
+	if f := h.Field(name); f != nil {
+		return f.value
+	}
+	return ""
+}
+
+// Values returns the unfolded values of all fields called name.
+func (h *Header) Values(name string) []string {
+	var values []string
+	for _, f := range h.fields {
+		if f.is(name) {
+			values = append(values, f.value)
+		}
+	}
+	return values
+}
+
+// Add appends a field.
+func (h *Header) Add(name, value string) {
+	h.fields = append(h.fields, NewField(name, value))
+}
+
+// Set replaces the first field called name, keeping its position, and removes any others.
+// The field is appended when there is none.
+func (h *Header) Set(name, value string) {
+	replaced := false
+	h.Filter(func(f *Field) *Field {
+		if !f.is(name) {
+			return f
+		}
+		if replaced {
+			return nil
+		}
+		replaced = true
+		return NewField(name, value)
+	})
+	if !replaced {
+		h.Add(name, value)
+	}
+}
+
+// Del removes all fields called name.
+func (h *Header) Del(name string) {
+	h.Filter(func(f *Field) *Field {
+		if f.is(name) {
+			return nil
+		}
+		return f
+	})
+}
+
+// Filter replaces each field with the result of fn, removing it when fn returns nil.
+func (h *Header) Filter(fn func(f *Field) *Field) {
+	h.expand(func(f *Field) []*Field {
+		if f = fn(f); f != nil {
+			return []*Field{f}
+		}
+		return nil
+	})
+}
+
+// expand is Filter for functions that may replace a field with several.
+func (h *Header) expand(fn func(f *Field) []*Field) {
+	fields := h.fields[:0:0]
+	for _, f := range h.fields {
+		fields = append(fields, fn(f)...)
+	}
+	h.fields = fields
+}
+
+// Entity is a message or body part. Parse keeps every byte of the input, so writing an entity that
+// was not modified yields the input exactly.
+type Entity struct {
+	Header Header
+	// separator is the blank line ending the header block, empty when there is no body
+	separator []byte
+	body      []byte
+
+	// Parts are the children of a multipart entity, nil for other entities.
+	Parts    []*Entity
+	boundary string
+	preamble []byte
+	delims   [][]byte
+	closing  []byte
+}
+
+// Parse reads the header fields of raw and, for multipart entities, the part tree below it.
+func Parse(raw []byte) *Entity {
+	e := &Entity{}
+	offset := 0
+	start := -1
+	flush := func(end int) {
+		if start >= 0 {
+			e.Header.fields = append(e.Header.fields, parseField(raw[start:end]))
+			start = -1
+		}
+	}
+	for offset < len(raw) {
+		lineEnd := len(raw)
+		if end := bytes.IndexByte(raw[offset:], '\n'); end >= 0 {
+			lineEnd = offset + end + 1
+		}
+		line := raw[offset:lineEnd]
+		switch {
+		case len(bytes.TrimRight(line, "\r\n")) == 0:
+			flush(offset)
+			e.separator = line
+			e.setBody(raw[lineEnd:])
+			return e
+		case (line[0] == ' ' || line[0] == '\t') && start >= 0:
+			// continuation of the current field
+		default:
+			flush(offset)
+			start = offset
+		}
+		offset = lineEnd
+	}
+	flush(len(raw))
+	return e
+}
+
+func (e *Entity) setBody(body []byte) {
+	e.body = body
+	mediaType, params := e.MediaType()
+	if !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return
+	}
+	var parts [][]byte
+	e.preamble, e.delims, parts, e.closing = splitMultipart(body, params["boundary"])
+	if parts == nil {
+		return
+	}
+	e.boundary = params["boundary"]
+	for _, part := range parts {
+		e.Parts = append(e.Parts, Parse(part))
+	}
+}
+
+// splitMultipart splits body at the delimiter lines for boundary. The preceding line break belongs to
+// each delimiter, so concatenating preamble, each delimiter and part, and closing yields body again.
+func splitMultipart(body []byte, boundary string) (preamble []byte, delims, parts [][]byte, closing []byte) {
+	dash := []byte("--" + boundary)
+	partStart := -1
+	offset := 0
+	for offset < len(body) {
+		lineEnd := len(body)
+		if end := bytes.IndexByte(body[offset:], '\n'); end >= 0 {
+			lineEnd = offset + end + 1
+		}
+		line := bytes.TrimRight(body[offset:lineEnd], " \t\r\n")
+		if rest, ok := bytes.CutPrefix(line, dash); ok && (len(rest) == 0 || bytes.Equal(rest, []byte("--"))) {
+			delimStart := offset
+			if delimStart > 0 && body[delimStart-1] == '\n' {
+				delimStart--
+				if delimStart > 0 && body[delimStart-1] == '\r' {
+					delimStart--
+				}
+			}
+			if delimStart < partStart {
+				// the line break belongs to the previous delimiter, leaving this part empty
+				delimStart = partStart
+			}
+			if partStart < 0 {
+				preamble = body[:delimStart]
+			} else {
+				parts = append(parts, body[partStart:delimStart])
+			}
+			if len(rest) > 0 {
+				return preamble, delims, parts, body[delimStart:]
+			}
+			delims = append(delims, body[delimStart:lineEnd])
+			partStart = lineEnd
+		}
+		offset = lineEnd
+	}
+	if partStart < 0 {
+		return body, nil, nil, nil
+	}
+	parts = append(parts, body[partStart:])
+	return preamble, delims, parts, nil
+}
+
+// MediaType returns the parsed Content-Type, text/plain when it is missing or invalid.
+func (e *Entity) MediaType() (string, map[string]string) {
+	mediaType, params, err := mime.ParseMediaType(e.Header.Get("Content-Type"))
+	if err != nil {
+		return "text/plain", map[string]string{}
+	}
+	return mediaType, params
+}
+
+// Body returns the raw body of a leaf entity, still in its transfer encoding.
+func (e *Entity) Body() []byte {
+	return e.body
+}
+
+// SetBody replaces the raw body of a leaf entity. The body must match the Content-Transfer-Encoding.
+func (e *Entity) SetBody(body []byte) {
+	if len(e.separator) == 0 {
+		e.separator = []byte("\r\n")
+	}
+	e.body = body
+}
+
+// DecodedBody returns the body of a leaf entity with the Content-Transfer-Encoding removed.
+func (e *Entity) DecodedBody() ([]byte, error) {
+	switch strings.ToLower(e.Header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		compact := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, e.body)
+		data := make([]byte, base64.StdEncoding.DecodedLen(len(compact)))
+		n, err := base64.StdEncoding.Decode(data, compact)
+		return data[:n], err
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(e.body)))
+	}
+	return e.body, nil
+}
+
+// Filename returns the decoded filename from Content-Disposition or the Content-Type name.
+func (e *Entity) Filename() string {
+	var name string
+	if _, params, err := mime.ParseMediaType(e.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		_, params := e.MediaType()
+		name = params["name"]
+	}
+	if decoded, err := wordDecoder.DecodeHeader(name); err == nil {
+		name = decoded
+	}
+	return name
+}
+
+// IsAttachment reports whether a leaf entity is an attachment rather than inline body text.
+func (e *Entity) IsAttachment() bool {
+	if e.Parts != nil {
+		return false
+	}
+	disposition, _, _ := mime.ParseMediaType(e.Header.Get("Content-Disposition"))
+	return disposition == "attachment" || e.Filename() != ""
+}
+
+// Walk calls fn for e and every entity below it, depth first.
+func (e *Entity) Walk(fn func(*Entity)) {
+	fn(e)
+	for _, part := range e.Parts {
+		part.Walk(fn)
+	}
+}
+
+// Bytes returns the encoded entity.
+func (e *Entity) Bytes() []byte {
+	buf := &bytes.Buffer{}
+	_, _ = e.WriteTo(buf)
+	return buf.Bytes()
+}
+
+// WriteTo writes the encoded entity to w.
+func (e *Entity) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	for _, f := range e.Header.fields {
+		cw.write(f.raw)
+	}
+	cw.write(e.separator)
+	if e.Parts == nil {
+		cw.write(e.body)
+		return cw.n, cw.err
+	}
+	cw.write(e.preamble)
+	for i, part := range e.Parts {
+		if i < len(e.delims) {
+			cw.write(e.delims[i])
+		} else {
+			cw.write([]byte("\r\n--" + e.boundary + "\r\n"))
+		}
+		_, _ = part.WriteTo(cw)
+	}
+	cw.write(e.closing)
+	return cw.n, cw.err
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.write(p)
+	return len(p), cw.err
+}
+
+func (cw *countingWriter) write(p []byte) {
+	if cw.err != nil {
+		return
+	}
+	var n int
+	n, cw.err = cw.w.Write(p)
+	cw.n += int64(n)
+}
@@ -0,0 +1,132 @@
+package sesutil
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParse_RoundTrip(t *testing.T) {
+	messages := map[string]string{
+		"offload": strings.Replace(offloadMessage, "%s", "JVBERi0xLjQ=", 1),
+		"lf": "From: sender@example.com\n" +
+			"To: a@example.com,\n" +
+			"\tb@example.com\n" +
+			"\n" +
+			"body\n",
+		"nested": "Content-Type: multipart/mixed; boundary=a\r\n" +
+			"\r\n" +
+			"--a\r\n" +
+			"Content-Type: multipart/alternative; boundary=b\r\n" +
+			"\r\n" +
+			"--b\r\n" +
+			"\r\n" +
+			"plain\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<p>html</p>\r\n" +
+			"--b--\r\n" +
+			"--a--",
+		"malformed": " leading continuation\r\n" +
+			"From sender@example.com Mon Jan 1 00:00:00 2024\r\n" +
+			"Subject : spaced\r\n",
+		"unterminated": "Content-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\n\r\nno closing delimiter",
+		"binary":       "Content-Type: application/octet-stream\r\n\r\n\x00\xff\r\x00\n",
+		"empty":        "",
+		"empty part":   "Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n--b\r\n--b--\r\n",
+		"empty parts":  "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\n--b\r\n--b--",
+	}
+	for name, message := range messages {
+		if got := string(Parse([]byte(message)).Bytes()); got != message {
+			t.Errorf("%s: round trip = %q; want %q", name, got, message)
+		}
+	}
+}
+
+func TestParse_Parts(t *testing.T) {
+	root := Parse([]byte(strings.Replace(offloadMessage, "%s", "JVBERi0xLjQ=", 1)))
+	if len(root.Parts) != 3 {
+		t.Fatalf("expected 3 parts, got %d", len(root.Parts))
+	}
+	pdf := root.Parts[1]
+	if !pdf.IsAttachment() || pdf.Filename() != "report.pdf" {
+		t.Errorf("expected report.pdf attachment, got %q", pdf.Filename())
+	}
+	if data, err := pdf.DecodedBody(); err != nil || string(data) != "%PDF-1.4" {
+		t.Errorf("decoded body = %q, %v", data, err)
+	}
+	if root.Parts[0].IsAttachment() {
+		t.Error("expected the text part not to be an attachment")
+	}
+}
+
+func TestParse_EmptyParts(t *testing.T) {
+	for message, count := range map[string]int{
+		"Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n--b\r\n--b--\r\n":    1,
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\n--b\r\n--b--": 2,
+		"Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\n--b\n--b\n--b--\n":  3,
+	} {
+		if parts := Parse([]byte(message)).Parts; len(parts) != count {
+			t.Errorf("%q: expected %d parts, got %d", message, count, len(parts))
+		}
+	}
+}
+
+func FuzzParse_RoundTrip(f *testing.F) {
+	f.Add([]byte(strings.Replace(offloadMessage, "%s", "JVBERi0xLjQ=", 1)))
+	f.Add([]byte("Content-Type: multipart/mixed; boundary=\"b\"\r\n\r\n--b\r\n--b--\r\n"))
+	f.Add([]byte("Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\n\r\n--b\r\n--b--"))
+	f.Add([]byte("Content-Type: multipart/mixed; boundary=b\n\n--b\nContent-Type: multipart/mixed; boundary=c\n\n--c\n--c--\n--b--\n"))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		if got := Parse(raw).Bytes(); !bytes.Equal(got, raw) {
+			t.Errorf("round trip = %q; want %q", got, raw)
+		}
+	})
+}
+
+func TestHeader_Edit(t *testing.T) {
+	e := Parse([]byte("From: sender@example.com\r\n" +
+		"To: a@example.com,\r\n" +
+		" b@example.com\r\n" +
+		"Subject: =?utf-8?q?caf=C3=A9?=\r\n" +
+		"Received: one\r\n" +
+		"Received: two\r\n" +
+		"\r\n" +
+		"body\r\n"))
+
+	if to := e.Header.Get("to"); to != "a@example.com, b@example.com" {
+		t.Errorf("unfolded To = %q", to)
+	}
+	if subject := e.Header.Field("Subject").Decoded(); subject != "café" {
+		t.Errorf("decoded Subject = %q", subject)
+	}
+
+	e.Header.Set("From", "alias@example.com")
+	e.Header.Del("Received")
+	e.Header.Add("Subject", EncodeText("naïve"))
+
+	expected := "From: alias@example.com\r\n" +
+		"To: a@example.com,\r\n" +
+		" b@example.com\r\n" +
+		"Subject: =?utf-8?q?caf=C3=A9?=\r\n" +
+		"Subject: =?utf-8?q?na=C3=AFve?=\r\n" +
+		"\r\n" +
+		"body\r\n"
+	if got := string(e.Bytes()); got != expected {
+		t.Errorf("edited message = %q; want %q", got, expected)
+	}
+}
+
+func TestNewField_Fold(t *testing.T) {
+	value := strings.TrimSpace(strings.Repeat("recipient@example.com, ", 8))
+	raw := string(NewField("To", value).Raw())
+	for _, line := range strings.Split(strings.TrimSuffix(raw, "\r\n"), "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("line longer than %d: %q", maxLineLength, line)
+		}
+	}
+	if got := Parse([]byte(raw + "\r\n")).Header.Get("To"); got != value {
+		t.Errorf("unfolded value = %q; want %q", got, value)
+	}
+}
@@ -5,90 +5,329 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net/mail"
 	"strings"
+	"text/template"
 
 	sesTypes "github.com/aws/aws-sdk-go-v2/service/ses/types"
 )
 
-type part struct {
-	first      string
-	additional []string
+// Forward describes how Process rewrites a message for forwarding.
+type Forward struct {
+	// From is the verified address forwarded messages are sent from.
+	From string
+	// To is the address messages are forwarded to.
+	To string
+	// Alias is the address the message was received at, the first original To address when empty.
+	Alias string
+	// FromName is the template for the display name of the rewritten From, executed with HeaderData.
+	// ParseFromName(DefaultFromName) is used when nil.
+	FromName *template.Template
+	// Rules rewrite the header fields, DefaultHeaderRules when nil.
+	Rules HeaderRules
+	// ExtraHeaders, given as complete "Name: value" lines, are appended to the header block and
+	// replace original fields of the same name.
+	ExtraHeaders []string
+	// Preserve copies the body unchanged instead of normalizing its line endings to CRLF.
+	Preserve bool
+	// SubjectTag, when set, labels the Subject with the alias.
+	SubjectTag *SubjectTag
 }
 
-func Process(reader io.ReadCloser, from, to string) *sesTypes.RawMessage {
+type rewriter struct {
+	from  string
+	to    string
+	alias string
+	extra []string
+	rules HeaderRules
+	// fromName, when set, gives the display name of From, for example to name the original sender
+	fromName *template.Template
+	// replaced holds the lower case names of extra headers, original headers with these names are dropped
+	replaced map[string]bool
+	// preserve copies the body unchanged instead of normalizing its line endings to CRLF
+	preserve bool
+	// subjectTag, when set, labels the Subject with the alias
+	subjectTag *SubjectTag
+
+	// header is the original header block
+	header Header
+	data   HeaderData
+}
+
+func newRewriter(rules HeaderRules, from, to string, extraHeaders []string) *rewriter {
+	if rules == nil {
+		rules = DefaultHeaderRules()
+	}
+	rw := &rewriter{
+		from:     from,
+		to:       to,
+		extra:    extraHeaders,
+		rules:    rules,
+		replaced: make(map[string]bool),
+	}
+	for _, h := range extraHeaders {
+		if name, _, ok := strings.Cut(h, ":"); ok {
+			rw.replaced[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+	return rw
+}
+
+// DefaultFromName names the original sender, or their address when the From has no display name,
+// and the alias the message was received at.
+const DefaultFromName = "{{if .OriginalName}}{{.OriginalName}}{{else}}{{.OriginalAddress}}{{end}}{{if .Alias}} via {{.Alias}}{{end}}"
+
+var defaultFromName = template.Must(ParseFromName(DefaultFromName))
+
+// ParseFromName parses a display name template for Forward.FromName. The template is executed with
+// HeaderData, and its output is used as the display name with runs of whitespace collapsed and
+// RFC 2047 encoding applied where needed. An empty output leaves the address without a display name.
+func ParseFromName(text string) (*template.Template, error) {
+	return template.New("from-name").Parse(text)
+}
+
+// Process rewrites the headers of the message in reader for forwarding from -> to with
+// DefaultHeaderRules. Any extraHeaders, given as complete "Name: value" lines, are appended to the
+// header block and replace original headers of the same name. Only the header block is parsed and
+// held apart, the body is copied a line at a time into the returned message. Lines of any length
+// are supported, and an error reading the message is returned instead of a truncated message.
+func Process(reader io.ReadCloser, from, to string, extraHeaders ...string) (*sesTypes.RawMessage, error) {
+	return Forward{From: from, To: to, ExtraHeaders: extraHeaders}.Process(reader)
+}
+
+// ProcessPreserve is Process for messages whose body must not change, such as S/MIME or PGP/MIME
+// signed messages. Only the header block is rewritten and the body bytes are copied exactly.
+func ProcessPreserve(reader io.ReadCloser, from, to string, extraHeaders ...string) (*sesTypes.RawMessage, error) {
+	return Forward{From: from, To: to, ExtraHeaders: extraHeaders, Preserve: true}.Process(reader)
+}
+
+// Process rewrites the message in reader as described by f. The rewritten From has the display name
+// from f.FromName, by default naming the original sender and the alias as in
+// "Alice via shop@example.com" <forwarder@example.com>, and Reply-To is the original Reply-To or
+// From so replies reach the sender.
+func (f Forward) Process(reader io.ReadCloser) (*sesTypes.RawMessage, error) {
+	rw := newRewriter(f.Rules, f.From, f.To, f.ExtraHeaders)
+	rw.alias = f.Alias
+	rw.fromName = f.FromName
+	if rw.fromName == nil {
+		rw.fromName = defaultFromName
+	}
+	rw.preserve = f.Preserve
+	rw.subjectTag = f.SubjectTag
+	return rw.process(reader)
+}
+
+// ProcessReply rewrites a reply written by the owner so that it appears to come from the alias
+// address in from. Unlike Process, no X-Original-* headers are added and headers added by the
+// owner's mail provider are removed.
+func ProcessReply(reader io.ReadCloser, from, to string) (*sesTypes.RawMessage, error) {
+	return newRewriter(replyHeaderRules(), from, to, nil).process(reader)
+}
+
+func (rw *rewriter) process(reader io.ReadCloser) (*sesTypes.RawMessage, error) {
 	defer func() { _ = reader.Close() }()
 	buf := &bytes.Buffer{}
-	scanner := bufio.NewScanner(reader)
-	var mp *part
-
-	headerMode := true
-	for scanner.Scan() {
-		l := scanner.Text()
-		if headerMode && l == "" {
-			headerMode = false
-			if mp != nil {
-				mp.write(buf, from, to)
-				mp = nil
-			}
-			buf.WriteString("\r\n")
-			continue
+	if err := rw.rewrite(buf, reader); err != nil {
+		return nil, err
+	}
+	return &sesTypes.RawMessage{Data: buf.Bytes()}, nil
+}
+
+// rewrite copies the message in r to w, rewriting the header block. Only the header block is parsed,
+// the body is copied a line at a time with its line endings normalized to CRLF, or unchanged when
+// rw.preserve is set.
+func (rw *rewriter) rewrite(w io.Writer, r io.Reader) error {
+	reader := bufio.NewReader(r)
+	var header []byte
+	for {
+		line, err := reader.ReadBytes('\n')
+		header = append(header, line...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading message: %w", err)
 		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
 
-		if headerMode {
-			if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") {
-				if mp != nil {
-					mp.additional = append(mp.additional, l)
-				}
-			} else {
-				if mp != nil {
-					mp.write(buf, from, to)
-				}
-				mp = &part{first: l}
+	bw := bufio.NewWriter(w)
+	if _, err := rw.rewriteHeader(Parse(header)).WriteTo(bw); err != nil {
+		return err
+	}
+	if rw.preserve {
+		if _, err := io.Copy(bw, reader); err != nil {
+			return fmt.Errorf("reading message: %w", err)
+		}
+		return bw.Flush()
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("reading message: %w", err)
+		}
+		if len(line) > 0 {
+			if _, writeErr := bw.Write(crlf(line)); writeErr != nil {
+				return writeErr
 			}
-		} else {
-			buf.WriteString(l + "\r\n")
+		}
+		if err == io.EOF {
+			return bw.Flush()
 		}
 	}
-	if mp != nil {
-		mp.write(buf, from, to)
+}
+
+// rewriteHeader returns the header block of message rewritten, with its line endings normalized
+// to CRLF. message holds no more than the header block, so its body is never split into parts.
+func (rw *rewriter) rewriteHeader(message *Entity) *Entity {
+	rw.header = message.Header
+	rw.data = rw.headerData()
+
+	out := &Entity{Header: message.Header}
+	out.Header.Filter(func(f *Field) *Field {
+		if rw.replaced[strings.ToLower(f.name)] {
+			return nil
+		}
+		return f
+	})
+	out.Header.expand(rw.apply)
+	rw.addExtra(&out.Header)
+
+	if len(message.separator) > 0 {
+		out.separator = []byte("\r\n")
 	}
+	return out
+}
 
-	return &sesTypes.RawMessage{Data: buf.Bytes()}
+// crlf returns b with every line ending in CRLF, including a last line without one.
+func crlf(b []byte) []byte {
+	if len(b) == 0 {
+		return b
+	}
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	out := make([]byte, 0, len(b)+len(lines))
+	for _, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+		out = append(append(out, line...), '\r', '\n')
+	}
+	return out
+}
+
+// has reports whether the original message has a field called name.
+func (rw *rewriter) has(name string) bool {
+	return rw.header.Field(name) != nil
 }
 
-var ignoreHeaders = []string{
-	"dkim-", "from:", "return-path:", "to:", "sender:", "list-owner:",
+// field returns the unfolded value of the first original field called name.
+func (rw *rewriter) field(name string) string {
+	return rw.header.Get(name)
+}
+
+// headerData describes the original message for the rules, before any field is rewritten.
+func (rw *rewriter) headerData() HeaderData {
+	data := HeaderData{From: rw.from, To: rw.to, Alias: rw.alias}
+	from := rw.field("From")
+	if addr, err := mail.ParseAddress(from); err == nil {
+		data.OriginalName, data.OriginalAddress = addr.Name, addr.Address
+	} else {
+		data.OriginalAddress = from
+	}
+	if data.ReplyTo = rw.field("Reply-To"); data.ReplyTo == "" {
+		data.ReplyTo = from
+	}
+	if data.Alias == "" {
+		if list, err := mail.ParseAddressList(rw.field("To")); err == nil && len(list) > 0 {
+			data.Alias = list[0].Address
+		}
+	}
+	if addr, err := mail.ParseAddress(rw.from); err == nil && rw.fromName != nil && data.OriginalAddress != "" {
+		data.From = addr.Address
+		var sb strings.Builder
+		if err = rw.fromName.Execute(&sb, data); err == nil {
+			addr.Name = strings.Join(strings.Fields(sb.String()), " ")
+		}
+		data.From = FormatAddress(addr)
+	}
+	return data
 }
 
-func (m *part) write(b *bytes.Buffer, from, to string) {
+// addExtra adds the fields of set and preserve rules that are missing from the message, then the
+// extra headers.
+func (rw *rewriter) addExtra(header *Header) {
+	added := make(map[string]bool)
+	for i := range rw.rules {
+		rule := &rw.rules[i]
+		name := strings.ToLower(rule.Name)
+		if rule.Action != HeaderSet && rule.Action != HeaderPreserve || strings.HasSuffix(name, "*") ||
+			added[name] || rw.replaced[name] || rw.has(rule.Name) {
+			continue
+		}
+		value := rule.value(rw.data)
+		if value == "" {
+			continue
+		}
+		if rw.subjectTag != nil && name == "subject" {
+			value, _ = rw.subjectTag.apply(value, rw.data.Alias)
+		}
+		added[name] = true
+		header.Add(rule.Name, value)
+	}
+	if rw.subjectTag != nil && !added["subject"] && !rw.replaced["subject"] && !rw.has("Subject") {
+		if subject, ok := rw.subjectTag.apply("", rw.data.Alias); ok {
+			header.fields = append(header.fields, parseField([]byte("Subject: "+subject+"\r\n")))
+		}
+	}
+	for _, h := range rw.extra {
+		header.fields = append(header.fields, parseField([]byte(h+"\r\n")))
+	}
+}
 
-	writeLine := func(in string) {
-		b.WriteString(fmt.Sprintf("%s\r\n", in))
+// apply returns the fields the rules turn f into, with line endings normalized to CRLF.
+func (rw *rewriter) apply(f *Field) []*Field {
+	var rule *HeaderRule
+	if f.name != "" {
+		rule = rw.rules.match(f.name)
+	} else if bytes.HasPrefix(f.raw, []byte(" ")) || bytes.HasPrefix(f.raw, []byte("\t")) {
+		// a continuation line before the first field has nothing to continue
+		return nil
+	}
+	// tag labels the value written for the Subject
+	tag := func(name, value string) string {
+		if rw.subjectTag != nil && strings.EqualFold(name, "Subject") {
+			value, _ = rw.subjectTag.apply(value, rw.data.Alias)
+		}
+		return value
 	}
 
-	firstLower := strings.ToLower(m.first)
-	for _, header := range ignoreHeaders {
-		if strings.HasPrefix(firstLower, header) {
-			switch header {
-			case "from:":
-				writeLine(fmt.Sprintf("From: %s", from))
-				writeLine(fmt.Sprintf("X-Original-From: %s", strings.TrimSpace(m.first[len("from:"):])))
-				for _, s := range m.additional {
-					writeLine(fmt.Sprintf("X-Original-From-Cont: %s", s))
-				}
-			case "to:":
-				writeLine(fmt.Sprintf("To: %s", to))
-				writeLine(fmt.Sprintf("X-Original-To: %s", strings.TrimSpace(m.first[len("to:"):])))
-				for _, s := range m.additional {
-					writeLine(fmt.Sprintf("X-Original-To-Cont: %s", s))
-				}
+	if rule == nil || rule.Action == HeaderKeep {
+		if rw.subjectTag != nil && f.is("Subject") {
+			if subject, changed := rw.subjectTag.apply(f.value, rw.data.Alias); changed {
+				return []*Field{NewField(f.name, subject)}
 			}
-			return
 		}
+		return []*Field{{name: f.name, value: f.value, raw: crlf(f.raw)}}
 	}
 
-	writeLine(m.first)
-	for _, s := range m.additional {
-		writeLine(s)
+	data := rw.data
+	data.Value = f.value
+	name := rule.fieldName(f.name)
+	switch rule.Action {
+	case HeaderRename:
+		_, rest, _ := bytes.Cut(f.raw, []byte(":"))
+		return []*Field{{name: rule.To, value: f.value, raw: crlf(append([]byte(rule.To+":"), rest...))}}
+	case HeaderSet:
+		return []*Field{NewField(name, tag(name, rule.value(data)))}
+	case HeaderPreserve:
+		var fields []*Field
+		if rule.Value != "" {
+			fields = append(fields, NewField(name, tag(name, rule.value(data))))
+		}
+		return append(fields, NewField("X-Original-"+name, originalValue(name, data.Value)))
 	}
+	return nil
 }
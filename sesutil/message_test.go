@@ -1,9 +1,16 @@
 package sesutil
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"io"
+	"net/mail"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestProcess(t *testing.T) {
@@ -19,13 +26,20 @@ To: this should not be changed.
 	to := "destination@gmail.com"
 
 	reader := io.NopCloser(strings.NewReader(input))
-	rawMessage := Process(reader, from, to)
+	rawMessage, err := Process(reader, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
 	output := string(rawMessage.Data)
 
-	if !strings.Contains(output, "From: forwarder@mlctrez.com") {
+	if !strings.Contains(output, "From: \"sender@example.com via original@mlctrez.com\" <forwarder@mlctrez.com>\r\n") {
 		t.Errorf("Expected From header to be updated. Got:\n%s", output)
 	}
 
+	if !strings.Contains(output, "Reply-To: sender@example.com\r\n") {
+		t.Errorf("Expected Reply-To with the original sender. Got:\n%s", output)
+	}
+
 	if !strings.Contains(output, "To: destination@gmail.com") {
 		t.Errorf("Expected To header to be updated. Got:\n%s", output)
 	}
@@ -55,17 +69,272 @@ Body`
 	to := "destination@gmail.com"
 
 	reader := io.NopCloser(strings.NewReader(input))
-	rawMessage := Process(reader, from, to)
+	rawMessage, err := Process(reader, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
 	output := string(rawMessage.Data)
 
 	if !strings.Contains(output, "To: destination@gmail.com\r\n") {
 		t.Errorf("Expected To header to be updated. Got:\n%s", output)
 	}
 
-	if !strings.Contains(output, "X-Original-To: first@mlctrez.com,") {
-		t.Errorf("Expected first part of original To. Got:\n%s", output)
+	if !strings.Contains(output, "X-Original-To: first@mlctrez.com, second@mlctrez.com\r\n") {
+		t.Errorf("Expected the original To unfolded into one header. Got:\n%s", output)
+	}
+	if strings.Contains(output, "-Cont:") {
+		t.Errorf("Expected no continuation headers. Got:\n%s", output)
+	}
+}
+
+func TestProcess_OriginalHeaders(t *testing.T) {
+	recipients := strings.Repeat("recipient@mlctrez.com, ", 5)
+	input := "From: =?iso-8859-1?q?Andr=E9?= <andre@example.com>\n" +
+		"To: =?utf-8?q?Shop?= <shop@mlctrez.com>,\n" +
+		"\t" + recipients + "last@mlctrez.com\n" +
+		"Cc: \"Smith, Bob\" <bob@example.com>\n" +
+		"Reply-To: replies@example.com\n" +
+		"Subject: Test Email\n" +
+		"\n" +
+		"Body\n"
+
+	rawMessage, err := Process(io.NopCloser(strings.NewReader(input)), "forwarder@mlctrez.com", "destination@gmail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(rawMessage.Data)
+
+	for _, expected := range []string{
+		"X-Original-From: =?utf-8?q?Andr=C3=A9?= <andre@example.com>\r\n",
+		"X-Original-To: Shop <shop@mlctrez.com>, recipient@mlctrez.com,",
+		"Cc: \"Smith, Bob\" <bob@example.com>\r\nX-Original-Cc: \"Smith, Bob\" <bob@example.com>\r\n",
+		"Reply-To: replies@example.com\r\nX-Original-Reply-To: replies@example.com\r\n",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected %q. Got:\n%s", expected, output)
+		}
+	}
+	header := Parse(rawMessage.Data).Header
+	if to := header.Get("X-Original-To"); to != "Shop <shop@mlctrez.com>, "+recipients+"last@mlctrez.com" {
+		t.Errorf("unexpected X-Original-To %q", to)
+	}
+	for _, line := range strings.Split(output, "\r\n") {
+		if len(line) > maxLineLength {
+			t.Errorf("header line longer than %d: %q", maxLineLength, line)
+		}
+	}
+}
+
+func TestForward_ReplyTo(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		from     string
+		replyTo  string
+		extra    []string
+		expected string
+	}{
+		{
+			name:     "added from the original sender",
+			input:    "From: =?utf-8?q?Zo=C3=AB?= <zoe@example.com>\nTo: shop@mlctrez.com\n\nBody\n",
+			from:     "From: =?utf-8?b?Wm/DqyB2aWEgc2hvcEBtbGN0cmV6LmNvbQ==?= <forwarder@mlctrez.com>\r\n",
+			expected: "Reply-To: =?utf-8?q?Zo=C3=AB?= <zoe@example.com>\r\n",
+		},
+		{
+			name:     "existing kept",
+			input:    "From: Alice <alice@example.com>\nReply-To: support@example.com\nTo: shop@mlctrez.com\n\nBody\n",
+			from:     "From: \"Alice via shop@mlctrez.com\" <forwarder@mlctrez.com>\r\n",
+			expected: "Reply-To: support@example.com\r\nX-Original-Reply-To: support@example.com\r\n",
+		},
+		{
+			name:     "reply alias wins",
+			input:    "From: Alice <alice@example.com>\nTo: shop@mlctrez.com\n\nBody\n",
+			from:     "From: \"Alice via alias@mlctrez.com\" <forwarder@mlctrez.com>\r\n",
+			extra:    []string{"Reply-To: reply-01@mlctrez.com"},
+			expected: "Reply-To: reply-01@mlctrez.com\r\n",
+		},
+	}
+	for _, tc := range tests {
+		f := Forward{From: "forwarder@mlctrez.com", To: "destination@gmail.com", ExtraHeaders: tc.extra}
+		if tc.extra != nil {
+			f.Alias = "alias@mlctrez.com"
+		}
+		rawMessage, err := f.Process(io.NopCloser(strings.NewReader(tc.input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		output := string(rawMessage.Data)
+		if !strings.Contains(output, tc.from) || !strings.Contains(output, tc.expected) {
+			t.Errorf("%s: expected %q and %q. Got:\n%s", tc.name, tc.from, tc.expected, output)
+		}
+		if strings.Count(output, "Reply-To:") != strings.Count(tc.expected, "Reply-To:") {
+			t.Errorf("%s: unexpected Reply-To headers. Got:\n%s", tc.name, output)
+		}
+	}
+}
+
+func TestForward_FromName(t *testing.T) {
+	input := "From: =?utf-8?q?Zo=C3=AB?= <zoe@example.com>\nTo: shop@mlctrez.com\n\nBody\n"
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"{{.OriginalName}} ({{.OriginalAddress}}) via {{.Alias}}", "Zoë (zoe@example.com) via shop@mlctrez.com"},
+		{"{{.OriginalName}}\n  at {{.Alias}}", "Zoë at shop@mlctrez.com"},
+		{"Forwarder", "Forwarder"},
+		{"", ""},
+	}
+	for _, tc := range tests {
+		fromName, err := ParseFromName(tc.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := Forward{From: "Mail Forwarder <forwarder@mlctrez.com>", To: "destination@gmail.com", FromName: fromName}
+		rawMessage, err := f.Process(io.NopCloser(strings.NewReader(input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := Parse(rawMessage.Data).Header.Field("From")
+		if !isASCII(string(from.Raw())) {
+			t.Errorf("%q: expected an encoded From, got %q", tc.template, from.Raw())
+		}
+		addr, err := mail.ParseAddress(from.Value())
+		if err != nil || addr.Name != tc.expected || addr.Address != "forwarder@mlctrez.com" {
+			t.Errorf("%q: From = %q, %v; want display name %q", tc.template, from.Value(), err, tc.expected)
+		}
+	}
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProcess_ExtraHeaders(t *testing.T) {
+	input := "From: sender@example.com\nSubject: Test Email\n\nBody\n"
+
+	reader := io.NopCloser(strings.NewReader(input))
+	rawMessage, err := Process(reader, "forwarder@mlctrez.com", "destination@gmail.com", "X-Goemail-Verdict: spam")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(rawMessage.Data)
+
+	if !strings.HasSuffix(output, "X-Goemail-Verdict: spam\r\n\r\nBody\r\n") {
+		t.Errorf("Expected extra header at end of header block. Got:\n%s", output)
+	}
+}
+
+func TestProcess_ReplacesExtraHeaders(t *testing.T) {
+	input := "From: sender@example.com\nReply-To: other@example.com\nSubject: Test Email\n\nBody\n"
+
+	reader := io.NopCloser(strings.NewReader(input))
+	rawMessage, err := Process(reader, "forwarder@mlctrez.com", "destination@gmail.com", "Reply-To: reply-01@mlctrez.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(rawMessage.Data)
+
+	if strings.Contains(output, "other@example.com") || !strings.Contains(output, "Reply-To: reply-01@mlctrez.com") {
+		t.Errorf("Expected Reply-To header to be replaced. Got:\n%s", output)
+	}
+}
+
+func TestProcessReply(t *testing.T) {
+	input := "From: Owner <owner@gmail.com>\nTo: reply-01@mlctrez.com\nReceived: from mail.google.com\nX-Google-Smtp-Source: abc\nSubject: Re: Test\n\nBody\n"
+
+	reader := io.NopCloser(strings.NewReader(input))
+	rawMessage, err := ProcessReply(reader, "alias@mlctrez.com", "sender@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(rawMessage.Data)
+
+	expected := "From: alias@mlctrez.com\r\nTo: sender@example.com\r\nSubject: Re: Test\r\n\r\nBody\r\n"
+	if output != expected {
+		t.Errorf("Expected:\n%q\nGot:\n%q", expected, output)
+	}
+}
+
+func TestProcess_LongLine(t *testing.T) {
+	line := strings.Repeat("QUJD", 50000)
+	input := "From: sender@example.com\n\n" + line + "\nlast line\n"
+
+	rawMessage, err := Process(io.NopCloser(strings.NewReader(input)), "forwarder@mlctrez.com", "destination@gmail.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(rawMessage.Data), "\r\n\r\n"+line+"\r\nlast line\r\n") {
+		t.Errorf("expected the long line and the rest of the body to be kept, got %d bytes", len(rawMessage.Data))
 	}
-	if !strings.Contains(output, "X-Original-To-Cont:  second@mlctrez.com") {
-		t.Errorf("Expected second part of original To. Got:\n%s", output)
+}
+
+func TestProcess_ReadError(t *testing.T) {
+	reader := io.NopCloser(io.MultiReader(strings.NewReader("From: sender@example.com\n\npartial body"), iotest.ErrReader(errors.New("connection reset"))))
+
+	rawMessage, err := Process(reader, "forwarder@mlctrez.com", "destination@gmail.com")
+	if err == nil || rawMessage != nil {
+		t.Errorf("expected an error and no message, got %v", err)
+	}
+}
+
+func TestProcess_MultipartBody(t *testing.T) {
+	body := "--b\r\n--b\r\n\r\n--b--\r\n"
+	input := "From: sender@example.com\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" + body
+
+	for _, preserve := range []bool{false, true} {
+		forward := Forward{From: "forwarder@mlctrez.com", To: "destination@gmail.com", Preserve: preserve}
+		rawMessage, err := forward.Process(io.NopCloser(strings.NewReader(input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(string(rawMessage.Data), "\r\n\r\n"+body) {
+			t.Errorf("expected the body to be copied as is, got\n%s", rawMessage.Data)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestProcessPreserve_Golden rewrites each message in testdata and compares the result to its
+// .golden file. Run with -update after an intended change to the output.
+func TestProcessPreserve_Golden(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "*.eml"))
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("no messages in testdata: %v", err)
+	}
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			raw, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rawMessage, err := ProcessPreserve(io.NopCloser(bytes.NewReader(raw)), "forwarder@mlctrez.com", "destination@gmail.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if body, original := Parse(rawMessage.Data).Body(), Parse(raw).Body(); !bytes.Equal(body, original) {
+				t.Errorf("body changed:\n%q\nwant:\n%q", body, original)
+			}
+
+			golden := strings.TrimSuffix(input, ".eml") + ".golden"
+			if *update {
+				if err = os.WriteFile(golden, rawMessage.Data, 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(rawMessage.Data, expected) {
+				t.Errorf("output differs from %s:\n%q", golden, rawMessage.Data)
+			}
+		})
 	}
 }
@@ -0,0 +1,92 @@
+package sesutil
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"sort"
+)
+
+// Attachment is an attachment removed from a message by Offload.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	// Data is the decoded content of the attachment.
+	Data []byte
+}
+
+// OffloadFunc stores an attachment and returns a link to it.
+type OffloadFunc func(attachment Attachment) (link string, err error)
+
+// Offload replaces the largest attachments of the message in raw with text parts linking to where
+// store put them, until the message is no larger than limit. Parts that are not changed, and the
+// MIME structure around them, are copied unchanged.
+func Offload(raw []byte, limit int, store OffloadFunc) ([]byte, error) {
+	root := Parse(raw)
+
+	// the top level entity holds the message headers and is never replaced
+	var attachments []*Entity
+	sizes := make(map[*Entity]int)
+	for _, part := range root.Parts {
+		part.Walk(func(e *Entity) {
+			if e.IsAttachment() {
+				attachments = append(attachments, e)
+				sizes[e] = len(e.Bytes())
+			}
+		})
+	}
+	sort.SliceStable(attachments, func(i, j int) bool {
+		return sizes[attachments[i]] > sizes[attachments[j]]
+	})
+
+	size := len(raw)
+	for _, e := range attachments {
+		if size <= limit {
+			break
+		}
+		attachment := attachmentOf(e)
+		link, err := store(attachment)
+		if err != nil {
+			return nil, err
+		}
+		stub := offloadStub(attachment, link)
+		*e = *Parse(stub)
+		size += len(stub) - sizes[e]
+	}
+	if size > limit {
+		return nil, fmt.Errorf("message is %d bytes after offloading attachments, limit is %d", size, limit)
+	}
+	return root.Bytes(), nil
+}
+
+// offloadStub is a quoted-printable text part linking to where attachment was stored, named
+// after it so it stays recognizable among the attachments.
+func offloadStub(attachment Attachment, link string) []byte {
+	var stub bytes.Buffer
+	stub.WriteString("Content-Type: " + mime.FormatMediaType("text/plain", map[string]string{"charset": "utf-8"}) + "\r\n")
+	disposition := map[string]string{}
+	if attachment.Filename != "" {
+		disposition["filename"] = attachment.Filename + ".txt"
+	}
+	stub.WriteString("Content-Disposition: " + mime.FormatMediaType("inline", disposition) + "\r\n")
+	stub.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	w := quotedprintable.NewWriter(&stub)
+	_, _ = fmt.Fprintf(w, "The attachment \"%s\" (%s, %d bytes) was too large to forward. Download it from:\r\n%s",
+		attachment.Filename, attachment.ContentType, len(attachment.Data), link)
+	_ = w.Close()
+	return stub.Bytes()
+}
+
+func attachmentOf(e *Entity) Attachment {
+	contentType, _, err := mime.ParseMediaType(e.Header.Get("Content-Type"))
+	if err != nil {
+		contentType = "application/octet-stream"
+	}
+	data, decodeErr := e.DecodedBody()
+	if decodeErr != nil {
+		data = e.Body()
+	}
+	return Attachment{Filename: e.Filename(), ContentType: contentType, Data: data}
+}
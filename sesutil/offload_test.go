@@ -0,0 +1,107 @@
+package sesutil
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+const offloadMessage = "From: sender@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"This is a multi-part message in MIME format.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"See attached.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"%s\r\n" +
+	"--outer\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-Disposition: attachment; filename=\"small.png\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--outer--\r\n" +
+	"epilogue\r\n"
+
+func TestOffload(t *testing.T) {
+	pdf := strings.Repeat("%PDF-1.4 large content ", 200)
+	encoded := base64.StdEncoding.EncodeToString([]byte(pdf))
+	var lines []string
+	for len(encoded) > 76 {
+		lines = append(lines, encoded[:76])
+		encoded = encoded[76:]
+	}
+	lines = append(lines, encoded)
+	raw := []byte(strings.Replace(offloadMessage, "%s", strings.Join(lines, "\r\n"), 1))
+
+	var stored []Attachment
+	store := func(attachment Attachment) (string, error) {
+		stored = append(stored, attachment)
+		return "https://example.com/" + attachment.Filename, nil
+	}
+
+	output, err := Offload(raw, 2000, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stored) != 1 {
+		t.Fatalf("expected only the large attachment to be offloaded, got %d", len(stored))
+	}
+	if stored[0].Filename != "report.pdf" || stored[0].ContentType != "application/pdf" || string(stored[0].Data) != pdf {
+		t.Errorf("unexpected attachment %q %q with %d bytes", stored[0].Filename, stored[0].ContentType, len(stored[0].Data))
+	}
+
+	expected := strings.Replace(offloadMessage, "Content-Type: application/pdf; name=\"report.pdf\"\r\n"+
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		"%s\r\n", "Content-Type: text/plain; charset=utf-8\r\n"+
+		"Content-Disposition: inline; filename=report.pdf.txt\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n\r\n"+
+		"The attachment \"report.pdf\" (application/pdf, 4600 bytes) was too large to =\r\n"+
+		"forward. Download it from:\r\nhttps://example.com/report.pdf\r\n", 1)
+	if string(output) != expected {
+		t.Errorf("Expected:\n%q\nGot:\n%q", expected, string(output))
+	}
+}
+
+func TestOffloadStub(t *testing.T) {
+	stub := Parse(offloadStub(Attachment{Filename: "Q3 \"final\" Übersicht.pdf", ContentType: "application/pdf"}, "https://example.com/x"))
+	if filename := stub.Filename(); filename != "Q3 \"final\" Übersicht.pdf.txt" {
+		t.Errorf("filename = %q", filename)
+	}
+	body, err := stub.DecodedBody()
+	if err != nil || !strings.HasPrefix(string(body), "The attachment \"Q3 \"final\" Übersicht.pdf\" (application/pdf, 0 bytes)") {
+		t.Errorf("unexpected body %q %v", body, err)
+	}
+}
+
+func TestOffload_Unchanged(t *testing.T) {
+	raw := []byte(strings.Replace(offloadMessage, "%s", "JVBERi0=", 1))
+	output, err := Offload(raw, len(raw), func(Attachment) (string, error) {
+		t.Error("expected nothing to be offloaded")
+		return "", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != string(raw) {
+		t.Errorf("Expected message to be unchanged. Got:\n%q", string(output))
+	}
+}
+
+func TestOffload_TooLarge(t *testing.T) {
+	raw := []byte("From: sender@example.com\r\nSubject: Big\r\n\r\n" + strings.Repeat("x", 100))
+	if _, err := Offload(raw, 50, nil); err == nil {
+		t.Error("expected an error for a message without attachments over the limit")
+	}
+}
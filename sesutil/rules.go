@@ -0,0 +1,243 @@
+package sesutil
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HeaderAction is what a HeaderRule does with the header fields it matches.
+type HeaderAction string
+
+const (
+	// HeaderKeep copies the field unchanged.
+	HeaderKeep HeaderAction = "keep"
+	// HeaderDrop removes the field.
+	HeaderDrop HeaderAction = "drop"
+	// HeaderRename copies the field under the name in To.
+	HeaderRename HeaderAction = "rename"
+	// HeaderPreserve copies the field to a single X-Original-<Name> field, unfolded and with encoded
+	// display names decoded. When Value is set the field is replaced with it, otherwise it is removed.
+	// A missing field is added when Value is not empty.
+	HeaderPreserve HeaderAction = "preserve"
+	// HeaderSet replaces the value of the field with Value. A missing field is added when Value is not empty.
+	HeaderSet HeaderAction = "set"
+)
+
+// HeaderRule rewrites the header fields called Name.
+type HeaderRule struct {
+	// Name is a case insensitive field name, or a prefix followed by "*" such as "DKIM-*".
+	Name   string       `json:"name" yaml:"name"`
+	Action HeaderAction `json:"action" yaml:"action"`
+	// To is the new field name for HeaderRename.
+	To string `json:"to,omitempty" yaml:"to,omitempty"`
+	// Value is a text/template for HeaderSet and HeaderPreserve, executed with HeaderData.
+	Value string `json:"value,omitempty" yaml:"value,omitempty"`
+
+	tmpl *template.Template
+}
+
+// HeaderData is the data Value templates are executed with.
+type HeaderData struct {
+	// From is the address the message is forwarded from, with a display name naming the original sender.
+	From string
+	// To is the address the message is forwarded to.
+	To string
+	// Alias is the address on our domain the message was received at.
+	Alias string
+	// OriginalName and OriginalAddress are the decoded display name and the address of the original From.
+	OriginalName    string
+	OriginalAddress string
+	// ReplyTo is the original Reply-To, or the original From when there is none.
+	ReplyTo string
+	// Value is the unfolded value of the original field, empty when the field is added.
+	Value string
+}
+
+// HeaderRules are evaluated in order and the first rule matching a field applies to it.
+// Fields no rule matches are kept.
+type HeaderRules []HeaderRule
+
+// DefaultHeaderRules removes the headers that would make SES reject the forwarded message and
+// keeps the original From, To, Cc and Reply-To as X-Original-* fields. Reply-To is added with the
+// original From when it is missing, so replies go to the sender rather than the forwarder.
+func DefaultHeaderRules() HeaderRules {
+	return mustRules(
+		HeaderRule{Name: "DKIM-*", Action: HeaderDrop},
+		HeaderRule{Name: "From", Action: HeaderPreserve, Value: "{{.From}}"},
+		HeaderRule{Name: "Return-Path", Action: HeaderDrop},
+		HeaderRule{Name: "To", Action: HeaderPreserve, Value: "{{.To}}"},
+		HeaderRule{Name: "Cc", Action: HeaderPreserve, Value: "{{.Value}}"},
+		HeaderRule{Name: "Reply-To", Action: HeaderPreserve, Value: "{{.ReplyTo}}"},
+		HeaderRule{Name: "Sender", Action: HeaderDrop},
+		HeaderRule{Name: "List-Owner", Action: HeaderDrop},
+	)
+}
+
+// replyHeaderRules additionally drop headers added by the owner's mail provider, so replies do not
+// reveal the owner's mailbox, and do not add X-Original-* headers.
+func replyHeaderRules() HeaderRules {
+	return mustRules(
+		HeaderRule{Name: "Received", Action: HeaderDrop},
+		HeaderRule{Name: "X-Original-*", Action: HeaderDrop},
+		HeaderRule{Name: "X-Gm-*", Action: HeaderDrop},
+		HeaderRule{Name: "X-Google-*", Action: HeaderDrop},
+		HeaderRule{Name: "X-Received", Action: HeaderDrop},
+		HeaderRule{Name: "ARC-*", Action: HeaderDrop},
+		HeaderRule{Name: "Authentication-Results", Action: HeaderDrop},
+		HeaderRule{Name: "DKIM-*", Action: HeaderDrop},
+		HeaderRule{Name: "From", Action: HeaderSet, Value: "{{.From}}"},
+		HeaderRule{Name: "Return-Path", Action: HeaderDrop},
+		HeaderRule{Name: "To", Action: HeaderSet, Value: "{{.To}}"},
+		HeaderRule{Name: "Sender", Action: HeaderDrop},
+		HeaderRule{Name: "List-Owner", Action: HeaderDrop},
+	)
+}
+
+func mustRules(rules ...HeaderRule) HeaderRules {
+	if err := HeaderRules(rules).compile(); err != nil {
+		panic(err)
+	}
+	return rules
+}
+
+// ParseHeaderRules reads a JSON list of rules, such as
+//
+//	[{"name": "Sender", "action": "keep"}, {"name": "Subject", "action": "set", "value": "[fwd] {{.Value}}"}]
+//
+// or the same list in YAML:
+//
+//	# keep Sender, tag the Subject
+//	- name: Sender
+//	  action: keep
+//	- name: Subject
+//	  action: set
+//	  value: "[fwd] {{.Value}}"
+//
+// The rules are followed by DefaultHeaderRules, so they only need to cover the fields that should
+// be treated differently.
+func ParseHeaderRules(data []byte) (HeaderRules, error) {
+	var rules HeaderRules
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] == '[' || trimmed[0] == '{' {
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, err
+		}
+	} else if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+	return append(rules, DefaultHeaderRules()...), nil
+}
+
+func (r HeaderRules) compile() error {
+	for i := range r {
+		rule := &r[i]
+		if strings.TrimSpace(rule.Name) == "" {
+			return fmt.Errorf("header rule %d has no name", i)
+		}
+		switch rule.Action {
+		case HeaderKeep, HeaderDrop:
+		case HeaderRename:
+			if strings.TrimSpace(rule.To) == "" {
+				return fmt.Errorf("rename rule for %s has no to", rule.Name)
+			}
+		case HeaderSet, HeaderPreserve:
+			tmpl, err := template.New(rule.Name).Parse(rule.Value)
+			if err != nil {
+				return fmt.Errorf("value of %s rule for %s: %w", rule.Action, rule.Name, err)
+			}
+			rule.tmpl = tmpl
+		default:
+			return fmt.Errorf("unknown action %q for %s", rule.Action, rule.Name)
+		}
+	}
+	return nil
+}
+
+// match returns the first rule for the field called name.
+func (r HeaderRules) match(name string) *HeaderRule {
+	for i := range r {
+		if r[i].matches(name) {
+			return &r[i]
+		}
+	}
+	return nil
+}
+
+func (rule *HeaderRule) matches(name string) bool {
+	if prefix, ok := strings.CutSuffix(rule.Name, "*"); ok {
+		return len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix)
+	}
+	return strings.EqualFold(name, rule.Name)
+}
+
+// fieldName is the name written for fields matched by the rule, the original name for prefix rules.
+func (rule *HeaderRule) fieldName(original string) string {
+	if strings.HasSuffix(rule.Name, "*") {
+		return original
+	}
+	return rule.Name
+}
+
+func (rule *HeaderRule) value(data HeaderData) string {
+	if rule.tmpl == nil {
+		return rule.Value
+	}
+	var sb strings.Builder
+	if err := rule.tmpl.Execute(&sb, data); err != nil {
+		return rule.Value
+	}
+	return sb.String()
+}
+
+// addressFields hold address lists, whose display names are decoded one address at a time.
+var addressFields = map[string]bool{
+	"from": true, "to": true, "cc": true, "bcc": true, "reply-to": true, "sender": true,
+	"resent-from": true, "resent-to": true, "resent-cc": true, "resent-sender": true,
+}
+
+// originalValue returns the unfolded value of field name for an X-Original-* field. Encoded words
+// are decoded and the value re-encoded only where it is not plain ASCII, as SES requires.
+func originalValue(name, value string) string {
+	value = strings.TrimSpace(unfold(value))
+	if addressFields[strings.ToLower(name)] {
+		if list, err := mail.ParseAddressList(value); err == nil {
+			formatted := make([]string, 0, len(list))
+			for _, addr := range list {
+				formatted = append(formatted, FormatAddress(addr))
+			}
+			return strings.Join(formatted, ", ")
+		}
+	}
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return EncodeText(decoded)
+}
+
+// FormatAddress formats addr for a header field. Unlike mail.Address.String the display name is
+// only quoted or encoded when it needs to be, and an address without one has no angle brackets.
+func FormatAddress(addr *mail.Address) string {
+	if addr.Name == "" {
+		return addr.Address
+	}
+	for _, r := range addr.Name {
+		if !isAtext(r) && r != ' ' {
+			return addr.String()
+		}
+	}
+	return addr.Name + " <" + addr.Address + ">"
+}
+
+// isAtext reports whether r may appear in an unquoted display name, from RFC 5322 section 3.2.3.
+func isAtext(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
@@ -0,0 +1,82 @@
+package sesutil
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestHeaderRules_Process(t *testing.T) {
+	rules, err := ParseHeaderRules([]byte(`[
+		{"name": "Sender", "action": "keep"},
+		{"name": "List-*", "action": "drop"},
+		{"name": "Message-ID", "action": "rename", "to": "X-Original-Message-ID"},
+		{"name": "Reply-To", "action": "preserve"},
+		{"name": "Subject", "action": "set", "value": "[fwd] {{.Value}}"},
+		{"name": "X-Forwarded-For", "action": "set", "value": "{{.To}}"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := "From: sender@example.com\n" +
+		"Sender: list@example.com\n" +
+		"List-Unsubscribe: <mailto:unsubscribe@example.com>\n" +
+		"List-Id: <list.example.com>\n" +
+		"Message-ID: <1@example.com>\n" +
+		"Reply-To: replies@example.com\n" +
+		"Subject: Weekly\n" +
+		"\n" +
+		"Body\n"
+	rawMessage, err := Forward{From: "forwarder@mlctrez.com", To: "destination@gmail.com", Rules: rules}.Process(io.NopCloser(strings.NewReader(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "From: \"sender@example.com\" <forwarder@mlctrez.com>\r\n" +
+		"X-Original-From: sender@example.com\r\n" +
+		"Sender: list@example.com\r\n" +
+		"X-Original-Message-ID: <1@example.com>\r\n" +
+		"X-Original-Reply-To: replies@example.com\r\n" +
+		"Subject: [fwd] Weekly\r\n" +
+		"X-Forwarded-For: destination@gmail.com\r\n" +
+		"To: destination@gmail.com\r\n" +
+		"\r\n" +
+		"Body\r\n"
+	if output := string(rawMessage.Data); output != expected {
+		t.Errorf("Expected:\n%q\nGot:\n%q", expected, output)
+	}
+}
+
+func TestParseHeaderRules_YAML(t *testing.T) {
+	rules, err := ParseHeaderRules([]byte(`
+# keep list headers, tag the subject
+- name: List-*
+  action: keep
+- name: Subject
+  action: set
+  value: "[fwd] {{.Value}}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != len(DefaultHeaderRules())+2 || rules[1].Action != HeaderSet || rules[1].Value != "[fwd] {{.Value}}" {
+		t.Errorf("unexpected rules %+v", rules)
+	}
+}
+
+func TestParseHeaderRules_Invalid(t *testing.T) {
+	for _, config := range []string{
+		`{"name": "Subject"}`,
+		`[{"name": "Subject", "action": "shout"}]`,
+		`[{"name": "Subject", "action": "rename"}]`,
+		`[{"name": "", "action": "drop"}]`,
+		`[{"name": "Subject", "action": "set", "value": "{{.Value"}]`,
+		"- name: Subject\n  action: shout\n",
+		"name: Subject\naction: drop\n",
+	} {
+		if _, err := ParseHeaderRules([]byte(config)); err == nil {
+			t.Errorf("expected an error for %s", config)
+		}
+	}
+}
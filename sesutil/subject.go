@@ -0,0 +1,54 @@
+package sesutil
+
+import "strings"
+
+// SubjectTag labels the Subject of forwarded messages with the alias they were received at, so
+// the alias shows in clients that hide X-Original-To, e.g. "[shop-acme] Your order".
+type SubjectTag struct {
+	// Suffix appends the label to the subject instead of prefixing it.
+	Suffix bool
+	// Labels maps lower case aliases to their label. Other aliases are labelled with the alias itself.
+	Labels map[string]string
+}
+
+// label returns the bracketed label for alias, empty when there is no alias.
+func (t *SubjectTag) label(alias string) string {
+	alias = strings.ToLower(alias)
+	if label, ok := t.Labels[alias]; ok {
+		alias = label
+	}
+	if alias == "" {
+		return ""
+	}
+	return "[" + alias + "]"
+}
+
+// apply returns the unfolded subject value tagged with the label for alias, re-encoded where needed,
+// and whether it was changed. A subject that already carries the label, such as a reply, is unchanged.
+func (t *SubjectTag) apply(value, alias string) (string, bool) {
+	label := t.label(alias)
+	if label == "" {
+		return value, false
+	}
+	join := func(subject string) string {
+		switch {
+		case subject == "":
+			return label
+		case t.Suffix:
+			return subject + " " + label
+		}
+		return label + " " + subject
+	}
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		// a charset we can't decode, so the encoded words are kept as they are
+		if strings.Contains(value, label) {
+			return value, false
+		}
+		return join(value), true
+	}
+	if strings.Contains(decoded, label) {
+		return value, false
+	}
+	return EncodeText(join(decoded)), true
+}
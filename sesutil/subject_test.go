@@ -0,0 +1,50 @@
+package sesutil
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSubjectTag(t *testing.T) {
+	tag := &SubjectTag{Labels: map[string]string{"shop@mlctrez.com": "shop-acme"}}
+	suffix := &SubjectTag{Suffix: true}
+	long := strings.Repeat("word ", 20)
+
+	tests := []struct {
+		name     string
+		tag      *SubjectTag
+		subject  string
+		expected string
+	}{
+		{"plain", tag, "Subject: Your order\n", "[shop-acme] Your order"},
+		{"suffix", suffix, "Subject: Your order\n", "Your order [shop@mlctrez.com]"},
+		{"encoded", tag, "Subject: =?utf-8?q?Caf=C3=A9?=\n =?utf-8?b?IG9yZGVy?=\n", "[shop-acme] Café order"},
+		{"folded", tag, "Subject: " + long + "\n\tcontinued\n", "[shop-acme] " + long + "\tcontinued"},
+		{"already tagged", tag, "Subject: Re: [shop-acme] Your order\n", "Re: [shop-acme] Your order"},
+		{"unknown charset", tag, "Subject: =?x-unknown?q?abc?=\n", "[shop-acme] =?x-unknown?q?abc?="},
+		{"missing", tag, "", "[shop-acme]"},
+	}
+	for _, tc := range tests {
+		input := "From: sender@example.com\nTo: shop@mlctrez.com\n" + tc.subject + "\nBody\n"
+		f := Forward{From: "forwarder@mlctrez.com", To: "destination@gmail.com", SubjectTag: tc.tag}
+		rawMessage, err := f.Process(io.NopCloser(strings.NewReader(input)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := Parse(rawMessage.Data).Header
+		if values := header.Values("Subject"); len(values) != 1 {
+			t.Errorf("%s: expected one Subject, got %q", tc.name, values)
+			continue
+		}
+		subject := header.Field("Subject")
+		if got := subject.Decoded(); got != tc.expected {
+			t.Errorf("%s: subject = %q; want %q", tc.name, got, tc.expected)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(string(subject.Raw()), "\r\n"), "\r\n") {
+			if len(line) > maxLineLength || !isASCII(line) {
+				t.Errorf("%s: invalid subject line %q", tc.name, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// subaddressLimit bounds the length of the subaddress added to EMAIL_TO.
+const subaddressLimit = 32
+
+// loadPlusAddress reads PLUS_ADDRESS, false when unset.
+func loadPlusAddress() bool {
+	value := strings.TrimSpace(os.Getenv("PLUS_ADDRESS"))
+	if value == "" {
+		return false
+	}
+	plus, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("ignoring invalid PLUS_ADDRESS %q", value)
+	}
+	return plus
+}
+
+// subaddress returns the local part of alias reduced to lower case letters, digits, dots and dashes,
+// with other runs of characters replaced by a dash and the result cut to subaddressLimit.
+func subaddress(alias string) string {
+	local, _, _ := strings.Cut(extractEmail(alias), "@")
+	var sb strings.Builder
+	dash := false
+	for _, r := range local {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.':
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			dash = false
+			sb.WriteRune(r)
+		default:
+			dash = true
+		}
+	}
+	sub := sb.String()
+	if len(sub) > subaddressLimit {
+		sub = sub[:subaddressLimit]
+	}
+	return strings.Trim(sub, ".-")
+}
+
+// withSubaddress returns address with the subaddress for alias, address itself when alias has none.
+func withSubaddress(address, alias string) string {
+	sub := subaddress(alias)
+	local, domain, found := strings.Cut(address, "@")
+	if sub == "" || !found {
+		return address
+	}
+	return local + "+" + sub + "@" + domain
+}
+
+// baseAddress returns address without its subaddress.
+func baseAddress(address string) string {
+	address = extractEmail(address)
+	local, domain, found := strings.Cut(address, "@")
+	if base, _, plus := strings.Cut(local, "+"); found && plus {
+		return base + "@" + domain
+	}
+	return address
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+func TestSubaddress(t *testing.T) {
+	tests := map[string]string{
+		"shop@mlctrez.com":                "shop",
+		"Shop.Acme@mlctrez.com":           "shop.acme",
+		"news_letter+x@mlctrez.com":       "news-letter-x",
+		"\"a b\"@mlctrez.com":             "a-b",
+		"-_-@mlctrez.com":                 "",
+		strings.Repeat("ab", 30) + "@x.y": strings.Repeat("ab", subaddressLimit/2),
+	}
+	for alias, expected := range tests {
+		if got := subaddress(alias); got != expected {
+			t.Errorf("subaddress(%q) = %q; want %q", alias, got, expected)
+		}
+	}
+}
+
+func TestWithSubaddress(t *testing.T) {
+	if got := withSubaddress("owner@gmail.com", "Shop@mlctrez.com"); got != "owner+shop@gmail.com" {
+		t.Errorf("withSubaddress = %q; want owner+shop@gmail.com", got)
+	}
+	if got := withSubaddress("owner@gmail.com", ""); got != "owner@gmail.com" {
+		t.Errorf("expected the base address without an alias, got %q", got)
+	}
+}
+
+func TestBaseAddress(t *testing.T) {
+	for address, expected := range map[string]string{
+		"Owner <owner@gmail.com>": "owner@gmail.com",
+		"owner+shop@gmail.com":    "owner@gmail.com",
+		"owner+@gmail.com":        "owner@gmail.com",
+		"owner2@gmail.com":        "owner2@gmail.com",
+		"other+owner@gmail.com":   "other@gmail.com",
+	} {
+		if got := baseAddress(address); got != expected {
+			t.Errorf("baseAddress(%q) = %q; want %q", address, got, expected)
+		}
+	}
+}
+
+func TestHandleRecord_PlusAddress(t *testing.T) {
+	mock := &mockS3{
+		getObjectFunc: func(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+			body := "From: sender@example.com\r\nTo: shop@mlctrez.com\r\nSubject: Order\r\n\r\nbody\r\n"
+			return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+		},
+	}
+	sesMock := &mockSES{}
+	h := &handler{
+		s3Client:    mock,
+		sesClient:   sesMock,
+		bucket:      aws.String("bucket"),
+		from:        "forwarder@mlctrez.com",
+		to:          "owner@gmail.com",
+		ec:          &mockNotifier{},
+		plusAddress: true,
+	}
+
+	record := events.SimpleEmailRecord{}
+	record.SES.Mail.MessageID = "message-id"
+	record.SES.Mail.Source = "sender@example.com"
+	record.SES.Mail.Destination = []string{"shop@mlctrez.com"}
+
+	h.handleRecord(context.Background(), record)
+	if len(sesMock.sent) != 1 || sesMock.sent[0].Destinations[0] != "owner+shop@gmail.com" {
+		t.Fatalf("expected the message to be sent to owner+shop@gmail.com, got %v", sesMock.sent)
+	}
+	if data := string(sesMock.sent[0].RawMessage.Data); !strings.Contains(data, "\r\nTo: owner+shop@gmail.com\r\n") {
+		t.Errorf("expected To to name the subaddress, got\n%s", data)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type verdictAction int
+
+const (
+	actionForward verdictAction = iota
+	actionTag
+	actionQuarantine
+	actionDrop
+)
+
+var verdictActionNames = map[string]verdictAction{
+	"forward":    actionForward,
+	"tag":        actionTag,
+	"quarantine": actionQuarantine,
+	"drop":       actionDrop,
+}
+
+func (a verdictAction) String() string {
+	for name, action := range verdictActionNames {
+		if action == a {
+			return name
+		}
+	}
+	return "unknown"
+}
+
+// verdictNames is ordered so the X-Goemail-Verdict header is stable.
+var verdictNames = []string{"spam", "virus", "spf", "dkim", "dmarc"}
+
+const verdictHeader = "X-Goemail-Verdict"
+
+// verdictPolicy maps a verdict name to the action taken when SES reports FAIL for it.
+type verdictPolicy map[string]verdictAction
+
+// loadVerdictPolicy reads VERDICT_SPAM, VERDICT_VIRUS, VERDICT_SPF, VERDICT_DKIM
+// and VERDICT_DMARC. Spam failures are tagged and virus failures quarantined unless configured otherwise.
+func loadVerdictPolicy() verdictPolicy {
+	policy := verdictPolicy{"spam": actionTag, "virus": actionQuarantine}
+	for _, name := range verdictNames {
+		value := strings.ToLower(strings.TrimSpace(os.Getenv("VERDICT_" + strings.ToUpper(name))))
+		if value == "" {
+			continue
+		}
+		action, ok := verdictActionNames[value]
+		if !ok {
+			log.Printf("ignoring unknown action %q for VERDICT_%s", value, strings.ToUpper(name))
+			continue
+		}
+		policy[name] = action
+	}
+	return policy
+}
+
+func receiptVerdicts(receipt events.SimpleEmailReceipt) map[string]string {
+	return map[string]string{
+		"spam":  receipt.SpamVerdict.Status,
+		"virus": receipt.VirusVerdict.Status,
+		"spf":   receipt.SPFVerdict.Status,
+		"dkim":  receipt.DKIMVerdict.Status,
+		"dmarc": receipt.DMARCVerdict.Status,
+	}
+}
+
+// evaluate returns the most severe action configured for the failing verdicts along with the
+// names of those verdicts. Failing verdicts configured to forward are left out.
+func (p verdictPolicy) evaluate(receipt events.SimpleEmailReceipt) (action verdictAction, failed []string) {
+	verdicts := receiptVerdicts(receipt)
+	for _, name := range verdictNames {
+		if !strings.EqualFold(verdicts[name], "FAIL") || p[name] == actionForward {
+			continue
+		}
+		failed = append(failed, name)
+		if p[name] > action {
+			action = p[name]
+		}
+	}
+	return action, failed
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestVerdictPolicy(t *testing.T) {
+	t.Setenv("VERDICT_VIRUS", "drop")
+	t.Setenv("VERDICT_DKIM", "quarantine")
+	t.Setenv("VERDICT_SPF", "bogus")
+	policy := loadVerdictPolicy()
+
+	fail := events.SimpleEmailVerdict{Status: "FAIL"}
+	pass := events.SimpleEmailVerdict{Status: "PASS"}
+
+	tests := []struct {
+		name     string
+		receipt  events.SimpleEmailReceipt
+		expected verdictAction
+		failed   int
+	}{
+		{"clean", events.SimpleEmailReceipt{SpamVerdict: pass, VirusVerdict: pass}, actionForward, 0},
+		{"spam", events.SimpleEmailReceipt{SpamVerdict: fail}, actionTag, 1},
+		{"spf", events.SimpleEmailReceipt{SPFVerdict: fail}, actionForward, 0},
+		{"spf and spam", events.SimpleEmailReceipt{SPFVerdict: fail, SpamVerdict: fail}, actionTag, 1},
+		{"dkim and spam", events.SimpleEmailReceipt{SpamVerdict: fail, DKIMVerdict: fail}, actionQuarantine, 2},
+		{"virus", events.SimpleEmailReceipt{VirusVerdict: fail, DKIMVerdict: fail}, actionDrop, 2},
+	}
+
+	t.Setenv("VERDICT_VIRUS", "")
+	if action := loadVerdictPolicy()["virus"]; action != actionQuarantine {
+		t.Errorf("virus default = %s; want quarantine", action)
+	}
+
+	for _, tc := range tests {
+		action, failed := policy.evaluate(tc.receipt)
+		if action != tc.expected {
+			t.Errorf("%s: action = %s; want %s", tc.name, action, tc.expected)
+		}
+		if len(failed) != tc.failed {
+			t.Errorf("%s: failed = %v; want %d entries", tc.name, failed, tc.failed)
+		}
+	}
+}